@@ -1,10 +1,153 @@
 package main
 
-import "github.com/NCATS-Gamma/robokache/internal/robokache"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/NCATS-Gamma/robokache/internal/robokache"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: robokache [command]
+
+Commands:
+  serve       Run the server (default)
+  rotate-key  Rewrap data keys with ROBOKACHE_MASTER_KEY
+  fsck        Check stored data against the database
+              -repair  remove orphaned blobs and stale uploads, fix reference counts
+              -verify  read every blob to check its digest
+  migrate     Apply pending database migrations
+              -dry-run  only list the pending migrations
+  cycles      Find documents that are their own ancestors
+              -repair  make the lowest ID in each cycle a root
+`
+
+// fail prints the error and exits
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// setupDB brings the database up to date or exits
+func setupDB(server *robokache.Server) {
+	err := server.SetupDB()
+	if err != nil {
+		fail(err)
+	}
+}
 
 func main() {
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "serve", "rotate-key", "fsck", "migrate", "cycles":
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if gin.Mode() == gin.DebugMode {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	config, err := robokache.ConfigFromEnv()
+	if err != nil {
+		fail(err)
+	}
+	server, err := robokache.New(config)
+	if err != nil {
+		fail(err)
+	}
+	defer server.Close()
+
+	switch command {
+	case "serve":
+		setupDB(server)
+		err = server.FsckOnStartup()
+		if err != nil {
+			fail(err)
+		}
+		go server.PurgeTrashEvery(context.Background(), time.Hour)
+		r := server.SetupRouter()
+		robokache.AddGUI(r)
+		r.Run(":8080") // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+	case "rotate-key":
+		setupDB(server)
+		rotated, err := server.RotateMasterKey()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Rewrapped %d data keys\n", rotated)
+	case "fsck":
+		flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "remove orphaned blobs and stale uploads, fix reference counts")
+		verify := flags.Bool("verify", false, "read every blob to check its digest")
+		flags.Parse(os.Args[2:])
+
+		setupDB(server)
+		report, err := server.Fsck(robokache.FsckOptions{Repair: *repair, Verify: *verify})
+		if err != nil {
+			fail(err)
+		}
+		fmt.Print(report.Summary())
+		// Missing and corrupt data can't be repaired
+		unrepaired := len(report.MissingBlobs) + len(report.CorruptBlobs)
+		if report.Problems() && (!report.Repaired || unrepaired > 0) {
+			os.Exit(1)
+		}
+	case "migrate":
+		flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "only list the pending migrations")
+		flags.Parse(os.Args[2:])
+
+		if *dryRun {
+			pending, err := server.PendingMigrations()
+			if err != nil {
+				fail(err)
+			}
+			for _, m := range pending {
+				fmt.Printf("Would apply %d: %s\n", m.Version, m.Description)
+			}
+			fmt.Printf("%d pending migrations\n", len(pending))
+			return
+		}
+		applied, err := server.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %d: %s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			fail(err)
+		}
+		fmt.Printf("Applied %d migrations\n", len(applied))
+	case "cycles":
+		flags := flag.NewFlagSet("cycles", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "make the lowest ID in each cycle a root")
+		flags.Parse(os.Args[2:])
 
-	r := robokache.SetupRouter()
-	robokache.AddGUI(r)
-	r.Run(":8080") // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+		setupDB(server)
+		cycles, err := server.CheckCycles(*repair)
+		if err != nil {
+			fail(err)
+		}
+		for _, cycle := range cycles {
+			fmt.Printf("Cycle: %v\n", cycle)
+		}
+		fmt.Printf("Found %d cycles\n", len(cycles))
+		if len(cycles) > 0 {
+			if *repair {
+				fmt.Println("The cycles were broken")
+			} else {
+				os.Exit(1)
+			}
+		}
+	}
 }
@@ -32,16 +32,7 @@ type HTTPClient interface {
 	Get(url string) (*http.Response, error)
 }
 
-var (
-	// Client is used to get the authentication certificates
-	Client HTTPClient
-)
-
-func init() {
-	Client = &http.Client{}
-}
-
-func validateUser(c *gin.Context) {
+func (s *Server) validateUser(c *gin.Context) {
 	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
 		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
 			// Verify 'aud' claim
@@ -78,7 +69,7 @@ func validateUser(c *gin.Context) {
 				return token, errors.New("invalid issuer")
 			}
 
-			cert, err := getPemCert(token)
+			cert, err := s.getPemCert(token)
 			if err != nil {
 				panic(err.Error())
 			}
@@ -100,9 +91,9 @@ func validateUser(c *gin.Context) {
 	c.Next()
 }
 
-func getPemCert(token *jwt.Token) (string, error) {
+func (s *Server) getPemCert(token *jwt.Token) (string, error) {
 	cert := ""
-	resp, err := Client.Get("https://qgraph.us.auth0.com/.well-known/jwks.json")
+	resp, err := s.client.Get("https://qgraph.us.auth0.com/.well-known/jwks.json")
 
 	if err != nil {
 		return cert, err
@@ -0,0 +1,287 @@
+package robokache
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Document data is content-addressed: each blob is stored under the SHA-256
+// digest of its content, so identical data uploaded to many documents is only
+// stored once. The blob table counts the documents that refer to each blob.
+
+// blobLockID identifies the PostgreSQL advisory lock that extends blobMu to
+// every replica using the same database
+const blobLockID = 0x626c6f62
+
+// lockBlobs locks blobMu, and the advisory lock with PostgreSQL,
+// until the returned function is called
+func (s *Server) lockBlobs() (func(), error) {
+	s.blobMu.Lock()
+	if !s.db.isPostgres() {
+		return s.blobMu.Unlock, nil
+	}
+
+	// Session locks belong to a connection, so hold on to one
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		s.blobMu.Unlock()
+		return nil, err
+	}
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, blobLockID)
+	if err != nil {
+		conn.Close()
+		s.blobMu.Unlock()
+		return nil, err
+	}
+	return func() {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, blobLockID)
+		if err != nil {
+			// Don't return a connection that may still hold the lock to the pool
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+		s.blobMu.Unlock()
+	}, nil
+}
+
+// Key that the blob with the given digest is stored under
+func blobKey(digest string) string {
+	return "sha256/" + digest[:2] + "/" + digest
+}
+
+// stagedBlob is a blob that has been written but not yet stored under its digest
+type stagedBlob struct {
+	key    string
+	digest string
+	// Size of the data before it is encoded
+	size     int64
+	encoding string
+	// Key that the blob is encrypted with
+	dataKey wrappedKey
+}
+
+// stageBlob writes r to a temporary key while hashing it.
+// The digest and size are those of the data before it is compressed.
+func (s *Server) stageBlob(r io.Reader) (stagedBlob, error) {
+	random, err := randomID()
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	staged := stagedBlob{key: "staging/" + random, encoding: s.storageEncoding()}
+
+	dataKey, wrapped, err := s.masterKeys.newDataKey()
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	staged.dataKey = wrapped
+	blob, err := s.createBlob(staged.key, dataKey)
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	var w io.Writer = blob
+	var zw *gzip.Writer
+	if staged.encoding == gzipEncoding {
+		zw = gzip.NewWriter(blob)
+		w = zw
+	}
+
+	// Hash the data as it is written
+	hash := sha256.New()
+	body := &bodyReader{r: r}
+	staged.size, err = io.Copy(io.MultiWriter(w, hash), body)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		blob.Abort()
+		var limit limitError
+		if errors.As(body.err, &limit) {
+			return stagedBlob{}, limit.error
+		}
+		if body.err != nil {
+			// The client went away or sent a broken body
+			return stagedBlob{}, fmt.Errorf("bad request: Failed to read data: %v", body.err)
+		}
+		return stagedBlob{}, err
+	}
+	err = blob.Commit()
+	if err != nil {
+		return stagedBlob{}, err
+	}
+	staged.digest = hex.EncodeToString(hash.Sum(nil))
+	return staged, nil
+}
+
+// createBlob creates a blob that is encrypted with dataKey, if it is not nil
+func (s *Server) createBlob(key string, dataKey []byte) (BlobWriter, error) {
+	blob, err := s.store.Create(key)
+	if err != nil || dataKey == nil {
+		return blob, err
+	}
+	encrypted, err := newEncryptWriter(blob, dataKey)
+	if err != nil {
+		blob.Abort()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// openBlob opens a blob, decrypting it if it is encrypted
+func (s *Server) openBlob(key string, dataKey wrappedKey) (io.ReadSeekCloser, error) {
+	plainKey, err := s.masterKeys.unwrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := s.store.Open(key)
+	if err != nil || plainKey == nil {
+		return blob, err
+	}
+	decrypted, err := newDecryptSeeker(blob, plainKey)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// bodyReader remembers read errors
+// so they can be told apart from errors writing to storage
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// putBlob moves a staged blob under its digest,
+// unless an identical blob is already stored
+func (s *Server) putBlob(staged stagedBlob) error {
+	// Check the blob table rather than the store, so that a blob left behind
+	// by a crash is replaced instead of being trusted
+	var stored int
+	err := s.db.Get(&stored, `SELECT COUNT(*) FROM blob WHERE sha256=?`, staged.digest)
+	if err != nil {
+		return err
+	}
+	if stored > 0 {
+		return s.store.Delete(staged.key)
+	}
+	return s.store.Rename(staged.key, blobKey(staged.digest))
+}
+
+// retainBlob adds a reference to a blob.
+// A blob that is already stored keeps the encoding and key it was stored with.
+func retainBlob(tx *transaction, blob stagedBlob) error {
+	_, err := tx.Exec(`
+		INSERT INTO blob(sha256, size, refs, encoding, key_id, wrapped_key)
+		VALUES (?, ?, 1, ?, ?, ?)
+		ON CONFLICT(sha256) DO UPDATE SET refs=blob.refs+1
+	`, blob.digest, blob.size, blob.encoding, blob.dataKey.KeyID, blob.dataKey.WrappedKey)
+	return err
+}
+
+// releaseBlob removes a reference to a blob.
+// Call deleteBlobIfUnused once the transaction is committed.
+func releaseBlob(tx *transaction, digest string) error {
+	_, err := tx.Exec(`UPDATE blob SET refs=refs-1 WHERE sha256=?`, digest)
+	return err
+}
+
+// deleteBlobIfUnused deletes a blob that no document refers to anymore
+func (s *Server) deleteBlobIfUnused(digest string) error {
+	var refs int
+	err := s.db.Get(&refs, `SELECT refs FROM blob WHERE sha256=?`, digest)
+	if err == nil && refs > 0 {
+		return nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = s.db.Exec(`DELETE FROM blob WHERE sha256=?`, digest)
+	if err != nil {
+		return err
+	}
+	err = s.store.Delete(blobKey(digest))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// deleteBlobsIfUnused calls deleteBlobIfUnused for each digest
+func (s *Server) deleteBlobsIfUnused(digests []string) error {
+	for _, digest := range digests {
+		err := s.deleteBlobIfUnused(digest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Key that data was stored under before it was content-addressed
+func legacyDataKey(id int) string {
+	return strconv.Itoa(id)
+}
+
+// legacyImportTask names the import of legacy data in the setup_task table
+const legacyImportTask = "import legacy data"
+
+// importLegacyData moves data stored under document IDs into the blob store.
+// It only runs until it has finished once, so that startup doesn't look
+// for legacy data of every document without data.
+func (s *Server) importLegacyData() error {
+	var finished int
+	err := s.db.Get(&finished, `SELECT COUNT(*) FROM setup_task WHERE name=?`, legacyImportTask)
+	if err != nil || finished > 0 {
+		return err
+	}
+
+	var ids []int
+	err = s.db.Select(&ids, `SELECT id FROM document WHERE data_sha256 IS NULL AND deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		legacy, err := s.store.Open(legacyDataKey(id))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// Data that was already stored does not count against quotas
+		err = s.setData(id, legacy, DataInfo{}, false)
+		legacy.Close()
+		if err != nil {
+			return err
+		}
+		err = s.store.Delete(legacyDataKey(id))
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"id": id}).Info("Imported document data")
+	}
+
+	// Replicas starting at the same time may both finish it
+	_, err = s.db.Exec(`INSERT INTO setup_task(name) VALUES (?) ON CONFLICT DO NOTHING`, legacyImportTask)
+	return err
+}
@@ -0,0 +1,117 @@
+package robokache
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Blobs can be stored gzip-compressed. Clients that accept gzip are sent the
+// compressed bytes as they are; for everyone else they are decompressed on the fly.
+
+// Encodings of stored blobs
+const (
+	identityEncoding = ""
+	gzipEncoding     = "gzip"
+)
+
+// Encoding used for new blobs, from ROBOKACHE_COMPRESSION
+func (s *Server) storageEncoding() string {
+	if s.config.Compression == "gzip" {
+		return gzipEncoding
+	}
+	return identityEncoding
+}
+
+// acceptsEncoding checks whether an Accept-Encoding header allows the encoding
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.TrimSpace(fields[0])
+		if name != encoding && name != "*" {
+			continue
+		}
+		// A quality of zero means "not acceptable"
+		accepted := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				accepted = err == nil && q > 0
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+// gunzipSeeker decompresses gzip data while still allowing seeks,
+// so that range requests can be served from compressed blobs.
+// Seeking backwards starts decompressing from the beginning again.
+type gunzipSeeker struct {
+	src io.ReadSeekCloser
+	// Size of the decompressed data
+	size   int64
+	offset int64
+	// Decompressed position of zr, or -1 if zr needs to be reset
+	position int64
+	zr       *gzip.Reader
+}
+
+func newGunzipSeeker(src io.ReadSeekCloser, size int64) *gunzipSeeker {
+	return &gunzipSeeker{src: src, size: size, position: -1}
+}
+
+func (g *gunzipSeeker) Read(p []byte) (int, error) {
+	if g.position < 0 || g.position > g.offset {
+		_, err := g.src.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		if g.zr == nil {
+			g.zr, err = gzip.NewReader(g.src)
+		} else {
+			err = g.zr.Reset(g.src)
+		}
+		if err != nil {
+			return 0, err
+		}
+		g.position = 0
+	}
+	// Skip ahead to the offset
+	if g.position < g.offset {
+		skipped, err := io.CopyN(io.Discard, g.zr, g.offset-g.position)
+		g.position += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := g.zr.Read(p)
+	g.position += int64(n)
+	g.offset += int64(n)
+	return n, err
+}
+
+func (g *gunzipSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += g.offset
+	case io.SeekEnd:
+		offset += g.size
+	default:
+		return 0, errors.New("gunzipSeeker.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("gunzipSeeker.Seek: negative position")
+	}
+	g.offset = offset
+	return offset, nil
+}
+
+func (g *gunzipSeeker) Close() error {
+	return g.src.Close()
+}
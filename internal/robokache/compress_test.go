@@ -0,0 +1,53 @@
+package robokache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip", "gzip"))
+	assert.True(t, acceptsEncoding("deflate, gzip;q=0.5", "gzip"))
+	assert.True(t, acceptsEncoding("*", "gzip"))
+	assert.False(t, acceptsEncoding("", "gzip"))
+	assert.False(t, acceptsEncoding("deflate, br", "gzip"))
+	assert.False(t, acceptsEncoding("gzip;q=0", "gzip"))
+}
+
+func TestGunzipSeeker(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+
+	g := newGunzipSeeker(nopCloser{bytes.NewReader(compressed.Bytes())}, int64(len(data)))
+
+	size, err := g.Seek(0, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+
+	// Seek forward
+	_, err = g.Seek(10, io.SeekStart)
+	assert.Nil(t, err)
+	part := make([]byte, 5)
+	_, err = io.ReadFull(g, part)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcde", string(part))
+
+	// Seek backwards
+	_, err = g.Seek(-13, io.SeekCurrent)
+	assert.Nil(t, err)
+	_, err = io.ReadFull(g, part)
+	assert.Nil(t, err)
+	assert.Equal(t, "23456", string(part))
+
+	rest, err := io.ReadAll(g)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data[7:]), string(rest))
+	assert.Nil(t, g.Close())
+}
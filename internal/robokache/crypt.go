@@ -0,0 +1,341 @@
+package robokache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Data is encrypted at rest with envelope encryption. Every blob gets its own
+// random data key, which is stored next to it wrapped (encrypted) by the master
+// key from the configuration. Rotating the master key only rewraps data keys.
+// Documents with identical data share a blob, so they also share its data key.
+
+// masterKey wraps and unwraps data keys
+type masterKey struct {
+	// Fingerprint of the key, stored with every key it wraps
+	id   string
+	aead cipher.AEAD
+}
+
+// keyring holds the master keys from ROBOKACHE_MASTER_KEY and
+// ROBOKACHE_OLD_MASTER_KEYS. Encryption is off if there are none.
+type keyring struct {
+	// Key that new data keys are wrapped with
+	current *masterKey
+	// All keys by ID, including old keys that may still wrap data keys
+	byID map[string]*masterKey
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(fingerprint[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, not %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadMasterKeys parses the base64 encoded current key and comma separated old keys
+func loadMasterKeys(current string, old string) (keyring, error) {
+	keys := keyring{byID: make(map[string]*masterKey)}
+	encoded := strings.Split(old, ",")
+	if current != "" {
+		encoded = append(encoded, current)
+	}
+	for _, e := range encoded {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return keys, fmt.Errorf("invalid master key: %v", err)
+		}
+		key, err := newMasterKey(raw)
+		if err != nil {
+			return keys, fmt.Errorf("invalid master key: %v", err)
+		}
+		keys.byID[key.id] = key
+		keys.current = key
+	}
+	if current == "" {
+		keys.current = nil
+	}
+	return keys, nil
+}
+
+// wrappedKey is a data key as it is stored, null if the data is not encrypted
+type wrappedKey struct {
+	KeyID      *string `db:"key_id"`
+	WrappedKey []byte  `db:"wrapped_key"`
+}
+
+// newDataKey makes a data key and wraps it with the current master key.
+// It returns a nil key if encryption is off.
+func (k keyring) newDataKey() ([]byte, wrappedKey, error) {
+	master := k.current
+	if master == nil {
+		return nil, wrappedKey{}, nil
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, wrappedKey{}, err
+	}
+	wrapped, err := master.wrap(key)
+	if err != nil {
+		return nil, wrappedKey{}, err
+	}
+	return key, wrappedKey{KeyID: &master.id, WrappedKey: wrapped}, nil
+}
+
+func (m *masterKey) wrap(key []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// unwrap returns the data key, or nil if the data is not encrypted
+func (k keyring) unwrap(w wrappedKey) ([]byte, error) {
+	if w.KeyID == nil {
+		return nil, nil
+	}
+	master, ok := k.byID[*w.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s is not configured", *w.KeyID)
+	}
+	nonceSize := master.aead.NonceSize()
+	if len(w.WrappedKey) < nonceSize {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	return master.aead.Open(nil,
+		w.WrappedKey[:nonceSize], w.WrappedKey[nonceSize:], nil)
+}
+
+// RotateMasterKey rewraps every data key that is not wrapped with the current
+// master key. The data itself is not touched. It returns how many keys were rewrapped.
+func (s *Server) RotateMasterKey() (int, error) {
+	masterKeys := s.masterKeys
+	if masterKeys.current == nil {
+		return 0, errors.New("no master key is configured")
+	}
+	rotated := 0
+	for _, table := range []string{"blob", "upload"} {
+		idColumn := "id"
+		if table == "blob" {
+			idColumn = "sha256"
+		}
+		var rows []struct {
+			ID string `db:"id"`
+			wrappedKey
+		}
+		err := s.db.Select(&rows, fmt.Sprintf(`
+			SELECT %s AS id, key_id, wrapped_key FROM %s
+			WHERE key_id IS NOT NULL AND key_id<>?
+		`, idColumn, table), masterKeys.current.id)
+		if err != nil {
+			return rotated, err
+		}
+
+		for _, row := range rows {
+			key, err := masterKeys.unwrap(row.wrappedKey)
+			if err != nil {
+				return rotated, err
+			}
+			wrapped, err := masterKeys.current.wrap(key)
+			if err != nil {
+				return rotated, err
+			}
+			_, err = s.db.Exec(fmt.Sprintf(`
+				UPDATE %s SET key_id=?, wrapped_key=? WHERE %s=?
+			`, table, idColumn), masterKeys.current.id, wrapped, row.ID)
+			if err != nil {
+				return rotated, err
+			}
+			rotated++
+		}
+	}
+	log.WithFields(log.Fields{"keys": rotated, "master_key": masterKeys.current.id}).
+		Info("Rotated master key")
+	return rotated, nil
+}
+
+// Encrypted blobs are split into segments that are sealed separately, so that
+// they can be decrypted from any position. The nonce of each segment is its
+// number and a flag marking the last segment, which detects truncation.
+const (
+	segmentSize = 64 * 1024
+	tagSize     = 16
+)
+
+func segmentNonce(segment int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(segment))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts what is written to a blob
+type encryptWriter struct {
+	w       BlobWriter
+	aead    cipher.AEAD
+	buf     []byte
+	segment int64
+}
+
+func newEncryptWriter(w BlobWriter, key []byte) (*encryptWriter, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		// Only full segments are written here, so the last segment is
+		// always shorter than segmentSize
+		if len(e.buf) == segmentSize {
+			err := e.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.segment, last), e.buf, nil)
+	_, err := e.w.Write(sealed)
+	e.buf = e.buf[:0]
+	e.segment++
+	return err
+}
+
+func (e *encryptWriter) Commit() error {
+	err := e.seal(true)
+	if err != nil {
+		e.w.Abort()
+		return err
+	}
+	return e.w.Commit()
+}
+
+func (e *encryptWriter) Abort() error {
+	return e.w.Abort()
+}
+
+// decryptSeeker decrypts a blob, reading only the segments that are needed
+type decryptSeeker struct {
+	src  io.ReadSeekCloser
+	aead cipher.AEAD
+	// Decrypted size and number of segments
+	size     int64
+	segments int64
+	offset   int64
+	// Decrypted segment that was read last
+	segment int64
+	plain   []byte
+}
+
+func newDecryptSeeker(src io.ReadSeekCloser, key []byte) (*decryptSeeker, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSize, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	// The last segment is shorter than a full one, even if it is empty
+	segments := encryptedSize/(segmentSize+tagSize) + 1
+	if encryptedSize-(segments-1)*(segmentSize+tagSize) < tagSize {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	size := encryptedSize - segments*tagSize
+	return &decryptSeeker{
+		src: src, aead: aead, size: size, segments: segments, segment: -1,
+	}, nil
+}
+
+func (d *decryptSeeker) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	segment := d.offset / segmentSize
+	if segment != d.segment {
+		_, err := d.src.Seek(segment*(segmentSize+tagSize), io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, segmentSize+tagSize)
+		n, err := io.ReadFull(d.src, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := segment == d.segments-1
+		d.plain, err = d.aead.Open(d.plain[:0], segmentNonce(segment, last), sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt blob: %v", err)
+		}
+		d.segment = segment
+	}
+	n := copy(p, d.plain[d.offset%segmentSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *decryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("decryptSeeker.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("decryptSeeker.Seek: negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decryptSeeker) Close() error {
+	return d.src.Close()
+}
@@ -0,0 +1,171 @@
+package robokache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Encrypt data into the memory store and open it for decryption
+func encryptedBlob(t *testing.T, s BlobStore, data []byte, key []byte) io.ReadSeekCloser {
+	blob, err := s.Create("encrypted")
+	assert.Nil(t, err)
+	w, err := newEncryptWriter(blob, key)
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Commit())
+
+	r, err := s.Open("encrypted")
+	assert.Nil(t, err)
+	return r
+}
+
+// mustLoadMasterKeys loads master keys that are known to be valid
+func mustLoadMasterKeys(current string, old string) keyring {
+	keys, err := loadMasterKeys(current, old)
+	fatal(err)
+	return keys
+}
+
+func TestDecryptSeeker(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	for _, size := range []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+		s := newMemoryStore()
+		stored := encryptedBlob(t, s, data, key)
+
+		d, err := newDecryptSeeker(stored, key)
+		assert.Nil(t, err, "size %d", size)
+		decrypted, err := io.ReadAll(d)
+		assert.Nil(t, err, "size %d", size)
+		assert.True(t, bytes.Equal(data, decrypted), "size %d", size)
+
+		if size > segmentSize+10 {
+			// Read across a segment boundary from the middle
+			_, err = d.Seek(segmentSize-10, io.SeekStart)
+			assert.Nil(t, err)
+			part := make([]byte, 20)
+			_, err = io.ReadFull(d, part)
+			assert.Nil(t, err)
+			assert.Equal(t, data[segmentSize-10:segmentSize+10], part)
+		}
+		d.Close()
+	}
+}
+
+func TestDecryptSeekerTampered(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	data := make([]byte, 2*segmentSize+10)
+	s := newMemoryStore()
+	encryptedBlob(t, s, data, key).Close()
+	stored := s.blobs["encrypted"].data
+
+	// Cutting off the last segment is noticed
+	truncated := stored[:2*(segmentSize+tagSize)]
+	_, err := newDecryptSeeker(nopCloser{bytes.NewReader(truncated)}, key)
+	assert.NotNil(t, err)
+	truncated = stored[:segmentSize+tagSize+20]
+	d, err := newDecryptSeeker(nopCloser{bytes.NewReader(truncated)}, key)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(d)
+	assert.NotNil(t, err)
+
+	// Changing a byte fails authentication
+	changed := append([]byte{}, stored...)
+	changed[10] ^= 1
+	d, err = newDecryptSeeker(nopCloser{bytes.NewReader(changed)}, key)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(d)
+	assert.NotNil(t, err)
+
+	// A different key can't decrypt it
+	other := make([]byte, 32)
+	rand.Read(other)
+	d, err = newDecryptSeeker(nopCloser{bytes.NewReader(stored)}, other)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(d)
+	assert.NotNil(t, err)
+}
+
+func TestDataEncrypted(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	requestBody := "This data is kept secret on disk"
+	id, _ := srv.ids.idToHash(1)
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var blob struct {
+		SHA256 string `db:"sha256"`
+		wrappedKey
+	}
+	err := srv.db.Get(&blob, `SELECT sha256, key_id, wrapped_key FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, srv.masterKeys.current.id, *blob.KeyID)
+
+	// The stored bytes can't be decompressed without decrypting them first
+	stored, err := srv.store.Open(blobKey(blob.SHA256))
+	assert.Nil(t, err)
+	raw, _ := io.ReadAll(stored)
+	stored.Close()
+	assert.NotContains(t, string(raw), requestBody)
+	_, err = newGunzipSeeker(nopCloser{bytes.NewReader(raw)}, int64(len(requestBody))).Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	defer func() { srv.masterKeys = mustLoadMasterKeys(testMasterKey, "") }()
+	srv.clearDB()
+	srv.loadSampleData()
+
+	requestBody := "This data outlives its master key"
+	id, _ := srv.ids.idToHash(1)
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var digest string
+	assert.Nil(t, srv.db.Get(&digest, `SELECT sha256 FROM blob`))
+	stored, _ := srv.store.Open(blobKey(digest))
+	before, _ := io.ReadAll(stored)
+	stored.Close()
+
+	newKey := make([]byte, 32)
+	rand.Read(newKey)
+	encoded := base64.StdEncoding.EncodeToString(newKey)
+	srv.masterKeys = mustLoadMasterKeys(encoded, testMasterKey)
+
+	rotated, err := srv.RotateMasterKey()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rotated)
+
+	// The data is readable without the old key and was not rewritten
+	srv.masterKeys = mustLoadMasterKeys(encoded, "")
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+	stored, _ = srv.store.Open(blobKey(digest))
+	after, _ := io.ReadAll(stored)
+	stored.Close()
+	assert.Equal(t, before, after)
+
+	rotated, err = srv.RotateMasterKey()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, rotated)
+}
@@ -0,0 +1,88 @@
+package robokache
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckCycles finds documents that are their own ancestors, which moves and
+// edits refuse to make but older databases may have. Each cycle is given as
+// its IDs, lowest first. With repair, the lowest ID in each cycle is made a
+// root, which breaks the cycle.
+func (s *Server) CheckCycles(repair bool) ([][]int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = lockTree(tx)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID     int  `db:"id"`
+		Parent *int `db:"parent"`
+	}
+	// Documents in the trash too, as they may be restored
+	err = tx.Select(&rows, `SELECT id, parent FROM document WHERE parent IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[int]int)
+	for _, row := range rows {
+		parents[row.ID] = *row.Parent
+	}
+
+	cycles := findCycles(parents)
+	for _, cycle := range cycles {
+		log.WithFields(log.Fields{"documents": cycle}).Warn("Documents form a cycle")
+		if !repair {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE document SET parent=NULL WHERE id=?`, cycle[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cycles, tx.Commit()
+}
+
+// findCycles follows each document up through its parents until it reaches a
+// root, a document already followed, or a document on the current path,
+// which closes a cycle. Cycles are sorted by their lowest ID.
+func findCycles(parents map[int]int) [][]int {
+	ids := make([]int, 0, len(parents))
+	for id := range parents {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	cycles := make([][]int, 0)
+	done := make(map[int]bool)
+	for _, id := range ids {
+		onPath := make(map[int]bool)
+		var path []int
+		for current, ok := id, true; ok && !done[current]; current, ok = parents[current] {
+			if onPath[current] {
+				// The path from the first visit of current on is a cycle
+				start := 0
+				for path[start] != current {
+					start++
+				}
+				cycle := append([]int(nil), path[start:]...)
+				sort.Ints(cycle)
+				cycles = append(cycles, cycle)
+				break
+			}
+			onPath[current] = true
+			path = append(path, current)
+		}
+		for _, visited := range path {
+			done[visited] = true
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i][0] < cycles[j][0] })
+	return cycles
+}
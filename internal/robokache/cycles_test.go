@@ -0,0 +1,68 @@
+package robokache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditDocumentCycle(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	addTestDocument(9, 2, "me@robokache.com", shareable)
+
+	// Not its own parent, nor below its own descendants
+	for _, parent := range []int{1, 2, 9} {
+		requestBody := `{"parent": "` + hashOf(parent) + `"}`
+		w := performRequest(router, "PUT", "/api/document/"+hashOf(1), &signedString, &requestBody)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+	doc, err := srv.GetDocument(nil, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, doc.Parent)
+
+	// Keeping the parent is fine
+	requestBody := `{"parent": "` + hashOf(1) + `", "metadata": {"name": "edited"}}`
+	w := performRequest(router, "PUT", "/api/document/"+hashOf(2), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCheckCycles(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	// 1 -> 3 -> 9 -> 1, 10 is its own parent, and 11 hangs below a cycle
+	addTestDocument(9, 3, "me@robokache.com", shareable)
+	addTestDocument(10, 10, "me@robokache.com", shareable)
+	addTestDocument(11, 9, "me@robokache.com", shareable)
+	srv.db.MustExec(`UPDATE document SET parent=9 WHERE id=1`)
+
+	cycles, err := srv.CheckCycles(false)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{1, 3, 9}, {10}}, cycles)
+	cycles, err = srv.CheckCycles(false)
+	assert.Nil(t, err)
+	assert.Len(t, cycles, 2)
+
+	cycles, err = srv.CheckCycles(true)
+	assert.Nil(t, err)
+	assert.Len(t, cycles, 2)
+	for _, id := range []int{1, 10} {
+		doc, err := srv.GetDocument(nil, id)
+		assert.Nil(t, err)
+		assert.Nil(t, doc.Parent)
+	}
+	doc, err := srv.GetDocument(nil, 9)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, *doc.Parent)
+	cycles, err = srv.CheckCycles(false)
+	assert.Nil(t, err)
+	assert.Empty(t, cycles)
+}
+
+func TestFindCycles(t *testing.T) {
+	assert.Empty(t, findCycles(map[int]int{}))
+	assert.Empty(t, findCycles(map[int]int{2: 1, 3: 2, 4: 2}))
+	// Reached from outside the cycle first
+	assert.Equal(t, [][]int{{2, 4, 5}, {6, 7}}, findCycles(map[int]int{1: 5, 5: 4, 4: 2, 2: 5, 3: 6, 6: 7, 7: 6}))
+}
@@ -1,30 +1,39 @@
 package robokache
 
 import (
+	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"           // makes database/sql point to PostgreSQL
 	_ "github.com/mattn/go-sqlite3" // makes database/sql point to SQLite
 )
 
 // Metadata is enforced to be a map of strings to any values
 type Metadata map[string]interface{}
 
-// Implement the sql.Scanner interface to convert metadata to bytes
+// Implement the sql.Scanner interface to convert metadata to JSON
 // for storage in the database
 func (m Metadata) Value() (driver.Value, error) {
-	return json.Marshal(m)
+	b, err := json.Marshal(m)
+	// PostgreSQL would take bytes for bytea, not JSON
+	return string(b), err
 }
 func (m Metadata) Scan(value interface{}) error {
-	b, ok := value.([]byte)
-	if !ok {
-		return fmt.Errorf("type assertion to []byte failed")
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, &m)
+	case string:
+		return json.Unmarshal([]byte(v), &m)
+	case nil:
+		return nil
 	}
-	return json.Unmarshal(b, &m)
+	return fmt.Errorf("type assertion to []byte failed")
 }
 
 type Document struct {
@@ -46,6 +55,19 @@ type Document struct {
 	Metadata Metadata `db:"metadata" json:"metadata"`
 	// Creation time field, automatically set
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// Hex SHA-256 digest and size in bytes of the document's data,
+	// null if there is none
+	DataSHA256 *string `db:"data_sha256" json:"data_sha256"`
+	DataSize   *int64  `db:"data_size"   json:"data_size"`
+	// When the data was last set
+	DataUpdatedAt *time.Time `db:"data_updated_at" json:"-"`
+	// Media type and file name the data was uploaded with, null if not given
+	ContentType *string `db:"content_type" json:"content_type"`
+	Filename    *string `db:"filename"     json:"filename"`
+	// When the document was moved to the trash, null if it is not in the trash
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+	// Document whose deletion moved this one to the trash
+	DeletedWith *int `db:"deleted_with" json:"-"`
 }
 
 type visibility int
@@ -71,15 +93,15 @@ var intToVisibility = []string{
 }
 
 // Change IDs in document to Hashes
-func (doc *Document) addHash() error {
+func (doc *Document) addHash(ids idCodec) error {
 	var err error
-	doc.Hash, err = idToHash(doc.ID)
+	doc.Hash, err = ids.idToHash(doc.ID)
 	if err != nil {
 		return err
 	}
 	// Change parent ID to hash
 	if doc.Parent != nil {
-		doc.ParentHash, err = idToHash(*doc.Parent)
+		doc.ParentHash, err = ids.idToHash(*doc.Parent)
 		if err != nil {
 			return err
 		}
@@ -88,9 +110,9 @@ func (doc *Document) addHash() error {
 }
 
 // Change Hashes (Parent and ID) in document to IDs
-func (doc *Document) addID() error {
+func (doc *Document) addID(ids idCodec) error {
 	if doc.Hash != "" {
-		newID, err := hashToID(doc.Hash)
+		newID, err := ids.hashToID(doc.Hash)
 		if err != nil {
 			return err
 		}
@@ -99,7 +121,7 @@ func (doc *Document) addID() error {
 
 	// Change parent ID to hash
 	if doc.ParentHash != "" {
-		newParentID, err := hashToID(doc.ParentHash)
+		newParentID, err := ids.hashToID(doc.ParentHash)
 		if err != nil {
 			return err
 		}
@@ -117,11 +139,70 @@ func (doc *Document) addOwned(owner string) {
 	}
 }
 
-func clearDB() error {
-	os.RemoveAll(dataDir + "/files")
-	os.MkdirAll(dataDir+"/files", 0755)
+// dataModTime is when the data of a document was last set
+func (doc *Document) dataModTime() time.Time {
+	if doc.DataUpdatedAt == nil {
+		return doc.CreatedAt
+	}
+	return *doc.DataUpdatedAt
+}
+
+// dataETag is an entity tag for the data of a document sent with the given
+// Content-Encoding. Data is stored under its digest, so the digest identifies it.
+func (doc *Document) dataETag(encoding string) string {
+	if doc.DataSHA256 == nil {
+		return ""
+	}
+	if encoding != identityEncoding {
+		return `"` + *doc.DataSHA256 + "-" + encoding + `"`
+	}
+	return `"` + *doc.DataSHA256 + `"`
+}
 
-	_, err := db.Exec(`DELETE FROM document`)
+func (s *Server) clearDB() error {
+	// Remove every stored blob and upload chunk before removing the rows
+	// that refer to them
+	var keys []string
+	err := s.db.Select(&keys, `SELECT sha256 FROM blob`)
+	if err != nil {
+		return err
+	}
+	for i, digest := range keys {
+		keys[i] = blobKey(digest)
+	}
+	var chunks []string
+	err = s.db.Select(&chunks, `SELECT key FROM upload_chunk`)
+	if err != nil {
+		return err
+	}
+	for _, key := range append(keys, chunks...) {
+		err = s.store.Delete(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	_, err = s.db.Exec(`DELETE FROM blob`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM document_revision`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM data_revision`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM upload_chunk`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM upload`)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM document`)
 	return err
 }
 
@@ -132,7 +213,7 @@ func makeDefaultDoc() Document {
 	}
 }
 
-func loadSampleData() error {
+func (s *Server) loadSampleData() error {
 	// Helper function to make an address from a constant
 	// The parent field needs to have a pointer to an int
 	// So this helps with that
@@ -155,52 +236,128 @@ func loadSampleData() error {
 	}
 
 	for _, doc := range sampleDocuments {
-		_, err := db.Exec(
+		_, err := s.db.Exec(
 			`INSERT INTO document(id, parent, owner, visibility, metadata) VALUES
 			(?, ?, ?, ?, ?)`, doc.ID, doc.Parent, doc.Owner, doc.Visibility, doc.Metadata)
 		if err != nil {
 			return err
 		}
 	}
+	if s.db.isPostgres() {
+		// Inserting IDs does not move the sequence that new IDs come from
+		_, err := s.db.Exec(`SELECT setval('document_id_seq', (SELECT MAX(id) FROM document))`)
+		return err
+	}
 	return nil
 }
 
-var db *sqlx.DB
+// database is a connection to SQLite or PostgreSQL. Queries are written
+// for SQLite with ? placeholders, which are rewritten for PostgreSQL.
+type database struct {
+	*sqlx.DB
+}
+
+func (d *database) isPostgres() bool {
+	return d.DriverName() == "postgres"
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.Exec(d.Rebind(query), args...)
+}
+
+func (d *database) MustExec(query string, args ...interface{}) sql.Result {
+	return d.DB.MustExec(d.Rebind(query), args...)
+}
 
-func mustExistDirectory(dir string) {
+func (d *database) Get(dest interface{}, query string, args ...interface{}) error {
+	return d.DB.Get(dest, d.Rebind(query), args...)
+}
+
+func (d *database) Select(dest interface{}, query string, args ...interface{}) error {
+	return d.DB.Select(dest, d.Rebind(query), args...)
+}
+
+func (d *database) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return d.DB.QueryRowx(d.Rebind(query), args...)
+}
+
+func (d *database) Beginx() (*transaction, error) {
+	tx, err := d.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{tx}, nil
+}
+
+// transaction is a transaction on a database, rewriting queries like it
+type transaction struct {
+	*sqlx.Tx
+}
+
+func (t *transaction) isPostgres() bool {
+	return t.DriverName() == "postgres"
+}
+
+func (t *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.Exec(t.Rebind(query), args...)
+}
+
+func (t *transaction) Get(dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.Get(dest, t.Rebind(query), args...)
+}
+
+func (t *transaction) Select(dest interface{}, query string, args ...interface{}) error {
+	return t.Tx.Select(dest, t.Rebind(query), args...)
+}
+
+// getter is a database or a transaction
+type getter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
+// connectDB connects to the database from the configuration, creating
+// it if it is a SQLite file that does not exist
+func connectDB(config Config) (*database, error) {
+	switch config.Database {
+	case "sqlite":
+		err := existDirectory(config.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		// Transactions take the write lock when they begin, so that one that
+		// reads before it writes waits for the others instead of failing
+		conn, err := sqlx.Connect("sqlite3", config.DataDir+"/db.sqlite3?_txlock=immediate")
+		if err != nil {
+			return nil, err
+		}
+		return &database{conn}, nil
+	case "postgres":
+		conn, err := sqlx.Connect("postgres", config.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		return &database{conn}, nil
+	default:
+		return nil, fmt.Errorf("unknown database %q, must be sqlite or postgres", config.Database)
+	}
+}
+
+// existDirectory creates dir if it does not exist
+func existDirectory(dir string) error {
 	info, err := os.Stat(dir)
 	if os.IsNotExist(err) {
-		err := os.Mkdir(dir, 0755)
+		err = os.Mkdir(dir, 0755)
 		if err != nil {
-			panic(fmt.Errorf("failed to create directory %s: %v", dir, err))
+			return fmt.Errorf("failed to create directory %s: %v", dir, err)
 		}
-		info, _ = os.Stat(dir)
-	} else if err != nil {
-		panic(err)
+		info, err = os.Stat(dir)
 	}
-	// If dir exists but is not a directory, panic
+	if err != nil {
+		return err
+	}
+	// If dir exists but is not a directory, fail
 	if !info.IsDir() {
-		panic(fmt.Errorf("\"%s\" file exists and is not a directory", dir))
+		return fmt.Errorf("\"%s\" file exists and is not a directory", dir)
 	}
-}
-
-// SetupDB sets up the SQLite database if it does not exist
-func init() {
-	// Create data directory
-	mustExistDirectory(dataDir)
-	mustExistDirectory(dataDir + "/files")
-
-	db = sqlx.MustConnect("sqlite3", dbFile)
-
-	sqlStmt := `
-		CREATE TABLE IF NOT EXISTS document (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			parent INTEGER,
-			owner TEXT,
-			visibility INTEGER,
-			metadata TEXT,
-			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp
-		);`
-
-	db.MustExec(sqlStmt)
+	return nil
 }
@@ -1,24 +1,199 @@
 package robokache
 
 import (
+	"database/sql"
 	"fmt"
 )
 
-// DeleteDocument deletes the document that matches the ID and Owner
-func DeleteDocument(doc Document) error {
-	result, err := db.Exec(`
+// Deleted documents are moved to the trash, where they are hidden from
+// everyone. Their owner can restore them or purge them for good, and they are
+// purged by themselves after ROBOKACHE_TRASH_RETENTION. Documents that are
+// deleted together are restored and purged together.
+
+// DeleteDocument moves the document that matches the ID and Owner to the trash.
+// A document with children is only deleted if recursive is set, and then
+// its whole subtree goes with it. It returns the IDs of the deleted documents.
+func (s *Server) DeleteDocument(doc Document, recursive bool) ([]int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids := []int{doc.ID}
+	if recursive {
+		ids, err = subtreeIDs(tx, doc.ID, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range ids {
+		result, err := tx.Exec(`
+			UPDATE document SET deleted_at=current_timestamp, deleted_with=?
+			WHERE id=? AND deleted_at IS NULL
+		`, doc.ID, id)
+		if err != nil {
+			return nil, err
+		}
+		rowsDeleted, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if rowsDeleted == 0 {
+			return nil, fmt.Errorf("bad request: Check that the document exists and belongs to you")
+		}
+	}
+
+	err = checkNoChildren(tx, ids, false)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// PurgeDocument permanently deletes a document in the trash
+// and its subtree. It returns the IDs of the purged documents.
+func (s *Server) PurgeDocument(doc Document) ([]int, error) {
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// It may have been restored in the meantime
+	query := `SELECT id FROM document WHERE id=? AND deleted_with=id`
+	if tx.isPostgres() {
+		query += " FOR UPDATE"
+	}
+	var trashed int
+	err = tx.Get(&trashed, query, doc.ID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("not found: Check that the document is in your trash")
+	} else if err != nil {
+		return nil, err
+	}
+
+	ids, err := subtreeIDs(tx, doc.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	var released []string
+	for _, id := range ids {
+		digests, err := deleteDocumentRow(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, digests...)
+	}
+
+	err = checkNoChildren(tx, ids, true)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return ids, s.deleteBlobsIfUnused(released)
+}
+
+// checkNoChildren fails if any of the documents has children other than the
+// given documents, counting children in the trash only if trashed is set.
+// It is called once the rows are locked by changing them, so that children
+// added in the meantime are seen.
+func checkNoChildren(tx *transaction, ids []int, trashed bool) error {
+	query := `SELECT COUNT(*) FROM document WHERE parent=?`
+	if !trashed {
+		query += ` AND deleted_at IS NULL`
+	}
+	for _, id := range ids {
+		var children int
+		err := tx.Get(&children, query, id)
+		if err != nil {
+			return err
+		}
+		if children > 0 {
+			return fmt.Errorf("conflict: Check that the document has no children, or delete them too with recursive=true")
+		}
+	}
+	return nil
+}
+
+// subtreeIDs lists the document with the given ID and its descendants,
+// leaving out those in the trash unless trashed is set
+func subtreeIDs(tx *transaction, id int, trashed bool) ([]int, error) {
+	condition := "document.deleted_at IS NULL"
+	if trashed {
+		condition = "TRUE"
+	}
+	var ids []int
+	// UNION rather than UNION ALL, so that a cycle can't recurse forever
+	err := tx.Select(&ids, fmt.Sprintf(`
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM document WHERE id=? AND %[1]s
+			UNION
+			SELECT document.id FROM document JOIN subtree ON document.parent=subtree.id
+			WHERE %[1]s
+		)
+		SELECT id FROM subtree
+	`, condition), id)
+	if err == nil && len(ids) == 0 {
+		return nil, fmt.Errorf("bad request: Check that the document exists and belongs to you")
+	}
+	return ids, err
+}
+
+// deleteDocumentRow deletes a document with its revisions and releases its
+// blobs. It returns the digests of the released blobs.
+func deleteDocumentRow(tx *transaction, id int) ([]string, error) {
+	// Release the document's data along with the document
+	var digest *string
+	err := tx.Get(&digest, `SELECT data_sha256 FROM document WHERE id=?`, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("bad request: Check that the document exists and belongs to you")
+	} else if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`
 		DELETE FROM document WHERE id=?;
-	`, doc.ID)
+	`, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	rowsDeleted, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if rowsDeleted == 0 {
-		return fmt.Errorf("bad request: Check that the document exists and belongs to you")
+		return nil, fmt.Errorf("bad request: Check that the document exists and belongs to you")
 	}
-	return nil
+
+	if digest != nil {
+		err = releaseBlob(tx, *digest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM document_revision WHERE document=?`, id)
+	if err != nil {
+		return nil, err
+	}
+	// Earlier data of the document goes too
+	released, err := pruneDataRevisions(tx, id, 0)
+	if err != nil {
+		return nil, err
+	}
+	if digest != nil {
+		released = append(released, *digest)
+	}
+	return released, nil
 }
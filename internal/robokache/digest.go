@@ -0,0 +1,37 @@
+package robokache
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Clients can check the data they send and receive against its SHA-256 digest
+// with the Repr-Digest header (RFC 9530) or the older Digest header (RFC 3230).
+
+// parseSHA256Digest returns the SHA-256 digest in a Repr-Digest or Digest header
+// as hex, or "" if the header has none. Other algorithms are ignored.
+func parseSHA256Digest(header string) (string, error) {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "sha-256") {
+			continue
+		}
+		// Repr-Digest puts the value between colons
+		encoded := strings.Trim(fields[1], ":")
+		digest, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(digest) != 32 {
+			return "", fmt.Errorf("bad request: Invalid SHA-256 digest %q", fields[1])
+		}
+		return hex.EncodeToString(digest), nil
+	}
+	return "", nil
+}
+
+// formatSHA256Digest turns a hex digest into Repr-Digest and Digest header values
+func formatSHA256Digest(digest string) (reprDigest string, legacyDigest string) {
+	raw, _ := hex.DecodeString(digest)
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	return "sha-256=:" + encoded + ":", "SHA-256=" + encoded
+}
@@ -0,0 +1,36 @@
+package robokache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSHA256Digest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	digest := hex.EncodeToString(sum[:])
+
+	reprDigest, legacyDigest := formatSHA256Digest(digest)
+	assert.Equal(t, "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:", reprDigest)
+	assert.Equal(t, "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=", legacyDigest)
+
+	for _, header := range []string{
+		reprDigest,
+		legacyDigest,
+		"sha-512=:abc:, " + reprDigest,
+		"md5=abc," + legacyDigest,
+	} {
+		parsed, err := parseSHA256Digest(header)
+		assert.Nil(t, err, header)
+		assert.Equal(t, digest, parsed, header)
+	}
+
+	parsed, err := parseSHA256Digest("sha-512=:abc:")
+	assert.Nil(t, err)
+	assert.Equal(t, "", parsed)
+
+	_, err = parseSHA256Digest("sha-256=:aGVsbG8=:")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,294 @@
+package robokache
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fsck checks that the database and the blob store agree. It finds blobs that
+// nothing refers to, blobs that are missing or damaged, and the documents
+// whose data is affected. With FsckOptions.Repair it also cleans up what can
+// be cleaned up; documents with missing data are only reported.
+
+// FsckOptions control what Fsck does
+type FsckOptions struct {
+	// Remove orphaned blobs and stale uploads and fix reference counts
+	Repair bool
+	// Read every blob to check its digest instead of only checking that it exists
+	Verify bool
+}
+
+// FsckReport is what Fsck found
+type FsckReport struct {
+	// Blobs in the blob table
+	Blobs int
+	// Keys in the store that nothing refers to, and their total size
+	OrphanedBlobs []string
+	OrphanedBytes int64
+	// Digests of blobs that are missing or whose content does not match
+	MissingBlobs []string
+	CorruptBlobs []string
+	// Documents whose current or earlier data is missing or corrupt
+	DamagedDocuments []int
+	// Digests of blobs whose reference count was wrong
+	WrongRefs []string
+	// Uploads that were not finished within ROBOKACHE_UPLOAD_EXPIRY
+	StaleUploads []string
+	// Whether the problems that can be fixed were fixed
+	Repaired bool
+}
+
+// Problems reports whether anything was found
+func (r FsckReport) Problems() bool {
+	return len(r.OrphanedBlobs) > 0 || len(r.MissingBlobs) > 0 ||
+		len(r.CorruptBlobs) > 0 || len(r.WrongRefs) > 0 || len(r.StaleUploads) > 0
+}
+
+// Summary describes the report in a few lines
+func (r FsckReport) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Checked %d blobs\n", r.Blobs)
+	fmt.Fprintf(&b, "Orphaned blobs: %d (%d bytes)\n", len(r.OrphanedBlobs), r.OrphanedBytes)
+	fmt.Fprintf(&b, "Missing blobs: %d\n", len(r.MissingBlobs))
+	fmt.Fprintf(&b, "Corrupt blobs: %d\n", len(r.CorruptBlobs))
+	fmt.Fprintf(&b, "Documents with missing or corrupt data: %d\n", len(r.DamagedDocuments))
+	fmt.Fprintf(&b, "Wrong reference counts: %d\n", len(r.WrongRefs))
+	fmt.Fprintf(&b, "Stale uploads: %d\n", len(r.StaleUploads))
+	if r.Repaired {
+		b.WriteString("Orphaned blobs, stale uploads and reference counts were repaired\n")
+	}
+	return b.String()
+}
+
+// Fsck checks the database against the blob store
+func (s *Server) Fsck(options FsckOptions) (FsckReport, error) {
+	// Hold off uploads from changing blobs while they are checked
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return FsckReport{}, err
+	}
+	defer unlock()
+
+	var report FsckReport
+	var blobs []struct {
+		SHA256   string `db:"sha256"`
+		Size     int64  `db:"size"`
+		Refs     int    `db:"refs"`
+		Encoding string `db:"encoding"`
+		wrappedKey
+	}
+	err = s.db.Select(&blobs, `
+		SELECT sha256, size, refs, encoding, key_id, wrapped_key FROM blob
+	`)
+	if err != nil {
+		return report, err
+	}
+	report.Blobs = len(blobs)
+
+	// Check that every blob is there
+	known := make(map[string]bool)
+	damaged := make(map[string]bool)
+	storedRefs := make(map[string]int)
+	for _, blob := range blobs {
+		storedRefs[blob.SHA256] = blob.Refs
+		known[blobKey(blob.SHA256)] = true
+		_, err = s.store.Stat(blobKey(blob.SHA256))
+		if errors.Is(err, os.ErrNotExist) {
+			log.WithFields(log.Fields{"sha256": blob.SHA256}).Warn("Blob is missing")
+			report.MissingBlobs = append(report.MissingBlobs, blob.SHA256)
+			damaged[blob.SHA256] = true
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		if options.Verify {
+			err = s.verifyBlob(blob.SHA256, blob.Size, blob.Encoding, blob.wrappedKey)
+			if err != nil {
+				log.WithFields(log.Fields{"sha256": blob.SHA256, "error": err}).Warn("Blob is corrupt")
+				report.CorruptBlobs = append(report.CorruptBlobs, blob.SHA256)
+				damaged[blob.SHA256] = true
+			}
+		}
+	}
+
+	// Count the references to each blob
+	var references []struct {
+		Document int    `db:"document"`
+		SHA256   string `db:"data_sha256"`
+	}
+	err = s.db.Select(&references, `
+		SELECT id AS document, data_sha256 FROM document WHERE data_sha256 IS NOT NULL
+		UNION ALL
+		SELECT document, data_sha256 FROM data_revision
+	`)
+	if err != nil {
+		return report, err
+	}
+	refs := make(map[string]int)
+	damagedDocuments := make(map[int]bool)
+	for _, reference := range references {
+		refs[reference.SHA256]++
+		if _, ok := storedRefs[reference.SHA256]; !ok && !damaged[reference.SHA256] {
+			// Referred to, but not in the blob table at all
+			log.WithFields(log.Fields{"sha256": reference.SHA256}).Warn("Blob is missing")
+			report.MissingBlobs = append(report.MissingBlobs, reference.SHA256)
+			damaged[reference.SHA256] = true
+		}
+		if damaged[reference.SHA256] && !damagedDocuments[reference.Document] {
+			log.WithFields(log.Fields{"id": reference.Document}).Warn("Document has missing or corrupt data")
+			damagedDocuments[reference.Document] = true
+			report.DamagedDocuments = append(report.DamagedDocuments, reference.Document)
+		}
+	}
+	unused := make([]string, 0)
+	for digest, stored := range storedRefs {
+		if stored != refs[digest] {
+			log.WithFields(log.Fields{"sha256": digest, "refs": stored, "actual": refs[digest]}).
+				Warn("Blob has the wrong reference count")
+			report.WrongRefs = append(report.WrongRefs, digest)
+		}
+		if refs[digest] == 0 {
+			unused = append(unused, digest)
+		}
+	}
+
+	// Uploads that were abandoned
+	var uploads []Upload
+	err = s.db.Select(&uploads, `SELECT * FROM upload`)
+	if err != nil {
+		return report, err
+	}
+	stale := make([]Upload, 0)
+	for _, upload := range uploads {
+		if time.Since(upload.CreatedAt) > s.config.UploadExpiry {
+			report.StaleUploads = append(report.StaleUploads, upload.ID)
+			stale = append(stale, upload)
+		}
+		keys, err := s.uploadedChunks(upload)
+		if err != nil {
+			return report, err
+		}
+		for _, key := range keys {
+			known[key] = true
+		}
+	}
+
+	// Anything else in the store is orphaned. Recent blobs are left
+	// alone since they may belong to uploads that are still running.
+	keys, err := s.store.List("")
+	if err != nil {
+		return report, err
+	}
+	for _, key := range keys {
+		if known[key] {
+			continue
+		}
+		info, err := s.store.Stat(key)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		if time.Since(info.ModTime) < s.config.FsckGrace {
+			continue
+		}
+		report.OrphanedBlobs = append(report.OrphanedBlobs, key)
+		report.OrphanedBytes += info.Size
+	}
+	for _, digest := range unused {
+		info, err := s.store.Stat(blobKey(digest))
+		if err == nil {
+			report.OrphanedBlobs = append(report.OrphanedBlobs, blobKey(digest))
+			report.OrphanedBytes += info.Size
+		}
+	}
+	sort.Strings(report.OrphanedBlobs)
+	for _, key := range report.OrphanedBlobs {
+		log.WithFields(log.Fields{"key": key}).Warn("Blob is orphaned")
+	}
+
+	if !options.Repair {
+		return report, nil
+	}
+
+	for _, digest := range report.WrongRefs {
+		_, err = s.db.Exec(`UPDATE blob SET refs=? WHERE sha256=?`, refs[digest], digest)
+		if err != nil {
+			return report, err
+		}
+	}
+	err = s.deleteBlobsIfUnused(unused)
+	if err != nil {
+		return report, err
+	}
+	for _, upload := range stale {
+		err = s.DeleteUpload(upload)
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, key := range report.OrphanedBlobs {
+		err = s.store.Delete(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// verifyBlob reads a blob and checks that it has the digest it is stored under
+func (s *Server) verifyBlob(digest string, size int64, encoding string, key wrappedKey) error {
+	blob, err := s.openBlob(blobKey(digest), key)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var r io.Reader = blob
+	if encoding == gzipEncoding {
+		zr, err := gzip.NewReader(blob)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("size is %d instead of %d", n, size)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("digest is %s", actual)
+	}
+	return nil
+}
+
+// FsckOnStartup runs Fsck if ROBOKACHE_FSCK asks for it
+func (s *Server) FsckOnStartup() error {
+	if s.config.Fsck == "" {
+		return nil
+	}
+	if s.config.Fsck != "check" && s.config.Fsck != "repair" {
+		return fmt.Errorf("ROBOKACHE_FSCK must be check or repair, not %s", s.config.Fsck)
+	}
+	report, err := s.Fsck(FsckOptions{Repair: s.config.Fsck == "repair"})
+	if err != nil {
+		return err
+	}
+	log.Info(report.Summary())
+	return nil
+}
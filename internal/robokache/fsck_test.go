@@ -0,0 +1,118 @@
+package robokache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func putBlobForTest(t *testing.T, key string, data string) {
+	w, err := srv.store.Create(key)
+	assert.Nil(t, err)
+	_, err = io.WriteString(w, data)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Commit())
+}
+
+func dataDigest(t *testing.T, id int) string {
+	var digest string
+	assert.Nil(t, srv.db.Get(&digest, `SELECT data_sha256 FROM document WHERE id=?`, id))
+	return digest
+}
+
+func TestFsck(t *testing.T) {
+	defer func(grace time.Duration) { srv.config.FsckGrace = grace }(srv.config.FsckGrace)
+	srv.config.FsckGrace = 0
+	defer func(s BlobStore) { srv.store = s }(srv.store)
+	srv.store = newMemoryStore()
+	srv.clearDB()
+	srv.loadSampleData()
+
+	for _, id := range []int{1, 2, 3} {
+		hash, _ := srv.ids.idToHash(id)
+		body := fmt.Sprintf("data of document %d", id)
+		w := performRequest(router, "PUT",
+			fmt.Sprintf(`/api/document/%s/data`, hash), &signedString, &body)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// Data of a deleted document from before data was content-addressed,
+	// a blob left behind by a crash and an interrupted upload
+	putBlobForTest(t, legacyDataKey(42), "deleted document")
+	putBlobForTest(t, "staging/crashed", "crashed upload")
+	uploadID, err := srv.CreateUpload("me@robokache.com", 1, uploadData, 100, DataInfo{})
+	assert.Nil(t, err)
+	upload, err := srv.GetUpload("me@robokache.com", uploadID)
+	assert.Nil(t, err)
+	_, err = srv.WriteUpload(upload, 0, strings.NewReader("part"))
+	assert.Nil(t, err)
+	_, err = srv.db.Exec(`UPDATE upload SET created_at=? WHERE id=?`,
+		time.Now().Add(-2*srv.config.UploadExpiry), uploadID)
+	assert.Nil(t, err)
+
+	// Lose the data of document 2, damage that of document 3
+	// and count a reference too many for document 1
+	assert.Nil(t, srv.store.Delete(blobKey(dataDigest(t, 2))))
+	putBlobForTest(t, blobKey(dataDigest(t, 3)), "not what was stored")
+	_, err = srv.db.Exec(`UPDATE blob SET refs=refs+1 WHERE sha256=?`, dataDigest(t, 1))
+	assert.Nil(t, err)
+
+	report, err := srv.Fsck(FsckOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Blobs)
+	assert.Equal(t, []string{"42", "staging/crashed"}, report.OrphanedBlobs)
+	assert.Equal(t, []string{dataDigest(t, 2)}, report.MissingBlobs)
+	assert.Empty(t, report.CorruptBlobs)
+	assert.Equal(t, []int{2}, report.DamagedDocuments)
+	assert.Equal(t, []string{dataDigest(t, 1)}, report.WrongRefs)
+	assert.Equal(t, []string{uploadID}, report.StaleUploads)
+	assert.False(t, report.Repaired)
+	assert.True(t, report.Problems())
+
+	// Checking changes nothing
+	_, err = srv.store.Stat("staging/crashed")
+	assert.Nil(t, err)
+
+	report, err = srv.Fsck(FsckOptions{Repair: true, Verify: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dataDigest(t, 3)}, report.CorruptBlobs)
+	assert.ElementsMatch(t, []int{2, 3}, report.DamagedDocuments)
+	assert.True(t, report.Repaired)
+
+	_, err = srv.store.Stat("staging/crashed")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = srv.GetUpload("me@robokache.com", uploadID)
+	assert.NotNil(t, err)
+	var refs int
+	assert.Nil(t, srv.db.Get(&refs, `SELECT refs FROM blob WHERE sha256=?`, dataDigest(t, 1)))
+	assert.Equal(t, 1, refs)
+
+	// Only the damaged data is left to report
+	report, err = srv.Fsck(FsckOptions{Verify: true})
+	assert.Nil(t, err)
+	assert.Empty(t, report.OrphanedBlobs)
+	assert.Empty(t, report.WrongRefs)
+	assert.Empty(t, report.StaleUploads)
+	assert.Equal(t, 1, len(report.MissingBlobs))
+	assert.Equal(t, 1, len(report.CorruptBlobs))
+}
+
+func TestFsckGrace(t *testing.T) {
+	defer func(s BlobStore) { srv.store = s }(srv.store)
+	srv.store = newMemoryStore()
+	srv.clearDB()
+	putBlobForTest(t, "staging/running", "upload in progress")
+
+	report, err := srv.Fsck(FsckOptions{Repair: true})
+	assert.Nil(t, err)
+	assert.Empty(t, report.OrphanedBlobs)
+	_, err = srv.store.Stat("staging/running")
+	assert.Nil(t, err)
+}
@@ -1,33 +1,32 @@
 package robokache
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
 	"io"
-	"os"
-	"strconv"
 
 	_ "github.com/mattn/go-sqlite3" // makes database/sql point to SQLite
 )
 
 // GetDocument gets all documents where owner = user OR visibility >= public.
-func GetDocuments(userEmail *string, hasParent *bool) ([]Document, error) {
+func (s *Server) GetDocuments(userEmail *string, hasParent *bool) ([]Document, error) {
 	docs := make([]Document, 0)
 	var err error
 
 	queryString := `
 		SELECT * FROM document
-		WHERE (owner=? OR visibility>=?)`
+		WHERE (owner=? OR visibility>=?) AND deleted_at IS NULL`
 	// If we are given hasParent add that to the query
 	if hasParent != nil {
 		if *hasParent {
-			queryString += "AND parent IS NOT NULL"
+			queryString += " AND parent IS NOT NULL"
 		} else {
-			queryString += "AND parent IS NULL"
+			queryString += " AND parent IS NULL"
 		}
 	}
 
-	err = db.Select(&docs, queryString, userEmail, public)
+	err = s.db.Select(&docs, queryString, userEmail, public)
 
 	if err != nil {
 		return nil, err
@@ -37,13 +36,13 @@ func GetDocuments(userEmail *string, hasParent *bool) ([]Document, error) {
 
 // Getdocument gets a document by ID.
 // It fails if its owner != user AND visibility < shareable.
-func GetDocument(userEmail *string, id int) (Document, error) {
+func (s *Server) GetDocument(userEmail *string, id int) (Document, error) {
 	var doc Document
 
 	// Get rows user is allowed to see
-	err := db.Get(&doc, `
+	err := s.db.Get(&doc, `
 		SELECT * FROM document
-		WHERE id=? AND (owner=? OR visibility>=?)
+		WHERE id=? AND (owner=? OR visibility>=?) AND deleted_at IS NULL
 	`, id, userEmail, shareable)
 
 	if err == sql.ErrNoRows {
@@ -56,12 +55,12 @@ func GetDocument(userEmail *string, id int) (Document, error) {
 }
 
 // Get all the documents with given id as the parent
-func GetDocumentChildren(userEmail *string, id int) ([]Document, error) {
+func (s *Server) GetDocumentChildren(userEmail *string, id int) ([]Document, error) {
 	docs := make([]Document, 0)
 
-	err := db.Select(&docs, `
+	err := s.db.Select(&docs, `
 		SELECT * FROM document
-		WHERE parent=? AND (owner=? OR visibility>=?)`,
+		WHERE parent=? AND (owner=? OR visibility>=?) AND deleted_at IS NULL`,
 		id, userEmail, shareable)
 
 	if err != nil {
@@ -71,39 +70,49 @@ func GetDocumentChildren(userEmail *string, id int) ([]Document, error) {
 	return docs, nil
 }
 
-func GetData(id int, w io.Writer) error {
-	filename := dataDir + "/files/" + strconv.Itoa(id)
+// Data is the data of a document, ready to be sent
+type Data struct {
+	io.ReadSeekCloser
+	// Content-Encoding of the data, empty if it is not encoded
+	Encoding string
+}
 
-	_, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		// If the file does not exist write nothing and just return
-		return nil
-	} else if err != nil {
-		return err
+// OpenData opens the data of a document for reading. Compressed data is
+// returned as stored if acceptEncoding allows it and decompressed otherwise.
+// Documents without data have empty data.
+func (s *Server) OpenData(doc Document, acceptEncoding string) (Data, error) {
+	if doc.DataSHA256 == nil {
+		return Data{ReadSeekCloser: nopCloser{bytes.NewReader(nil)}}, nil
 	}
 
-	// Open data file
-	file, err := os.Open(filename)
+	var blob struct {
+		Size     int64  `db:"size"`
+		Encoding string `db:"encoding"`
+		wrappedKey
+	}
+	err := s.db.Get(&blob, `
+		SELECT size, encoding, key_id, wrapped_key FROM blob WHERE sha256=?
+	`, *doc.DataSHA256)
 	if err != nil {
-		return err
+		return Data{}, err
 	}
-	defer file.Close()
 
-	// Use io.Copy to write without a buffer
-	_, err = io.Copy(w, file)
+	stored, err := s.openBlob(blobKey(*doc.DataSHA256), blob.wrappedKey)
 	if err != nil {
-		return err
+		return Data{}, err
 	}
-
-	return nil
+	if blob.Encoding == identityEncoding || acceptsEncoding(acceptEncoding, blob.Encoding) {
+		return Data{ReadSeekCloser: stored, Encoding: blob.Encoding}, nil
+	}
+	return Data{ReadSeekCloser: newGunzipSeeker(stored, blob.Size)}, nil
 }
 
 // Get document that we intend to edit
 // Checks that the document is owned by the current user
-func GetDocumentForEditing(userEmail string, id int) (Document, error) {
+func (s *Server) GetDocumentForEditing(userEmail string, id int) (Document, error) {
 	var doc Document
-	err := db.Get(&doc,
-		`SELECT * FROM document WHERE id=?`, id)
+	err := s.db.Get(&doc,
+		`SELECT * FROM document WHERE id=? AND deleted_at IS NULL`, id)
 	if err != nil && err != sql.ErrNoRows {
 		return doc, err
 	}
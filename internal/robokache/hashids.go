@@ -2,28 +2,27 @@ package robokache
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/speps/go-hashids"
 )
 
-var hid *hashids.HashID
+// idCodec converts database IDs to the hashes used in the API and back
+type idCodec struct {
+	hid *hashids.HashID
+}
 
-func init() {
+func newIDCodec() (idCodec, error) {
 	hd := hashids.NewData()
 	hd.Salt = "This salt is unguessable. Don't even try"
 	hd.MinLength = 8
 
-	var err error
-	hid, err = hashids.NewWithData(hd)
-	if err != nil {
-		log.Fatal(err)
-	}
+	hid, err := hashids.NewWithData(hd)
+	return idCodec{hid}, err
 }
 
 // Convert an API hash to an integer ID (database primary key)
-func hashToID(hash string) (int, error) {
-	ids, err := hid.DecodeWithError(hash)
+func (c idCodec) hashToID(hash string) (int, error) {
+	ids, err := c.hid.DecodeWithError(hash)
 	if err != nil || len(ids) != 1 {
 		return -1, fmt.Errorf("bad request: Invalid document ID")
 	}
@@ -31,10 +30,23 @@ func hashToID(hash string) (int, error) {
 }
 
 // Convert an API hash to an integer ID (database primary key)
-func idToHash(id int) (string, error) {
-	hash, err := hid.Encode([]int{id})
+func (c idCodec) idToHash(id int) (string, error) {
+	hash, err := c.hid.Encode([]int{id})
 	if err != nil {
 		return "", err
 	}
 	return hash, nil
 }
+
+// Convert integer IDs to API hashes
+func (c idCodec) idsToHashes(ids []int) ([]string, error) {
+	hashes := make([]string, len(ids))
+	for i, id := range ids {
+		var err error
+		hashes[i], err = c.idToHash(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
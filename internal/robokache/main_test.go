@@ -2,16 +2,20 @@ package robokache
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/gin-gonic/gin"
 
@@ -47,6 +51,10 @@ func (m *MockClient) Get(url string) (*http.Response, error) {
 }
 
 func performRequest(r http.Handler, method, path string, jwt *string, body *string) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(r, method, path, jwt, body, nil)
+}
+
+func performRequestWithHeaders(r http.Handler, method, path string, jwt *string, body *string, headers map[string]string) *httptest.ResponseRecorder {
 	var req *http.Request
 	if body == nil {
 		req, _ = http.NewRequest(method, path, nil)
@@ -56,12 +64,33 @@ func performRequest(r http.Handler, method, path string, jwt *string, body *stri
 	if jwt != nil {
 		req.Header.Add("Authorization", "Bearer "+*jwt)
 	}
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
 
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 	return w
 }
 
+// hashOf is the API hash of a document ID
+func hashOf(id int) string {
+	hash, _ := srv.ids.idToHash(id)
+	return hash
+}
+
+// addTestDocument adds a document with the given ID and parent
+// to the sample data
+func addTestDocument(id int, parent int, owner string, v visibility) {
+	srv.db.MustExec(`
+		INSERT INTO document(id, parent, owner, visibility, metadata)
+		VALUES (?, ?, ?, ?, '{}')
+	`, id, parent, owner, v)
+}
+
+// Base64 encoded key that test data is encrypted with
+const testMasterKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
 var (
 	privKeyPath = "../../test/certs/test.key"
 	pubKeyPath  = "../../test/certs/test.cert"
@@ -69,12 +98,31 @@ var (
 
 var (
 	signKey      *rsa.PrivateKey
+	srv          *Server
 	router       *gin.Engine
 	signedString string
 )
 
+// testConfig configures a server that keeps its database in dir
+// and its data in memory
+func testConfig(dir string) Config {
+	config := DefaultConfig()
+	config.DataDir = dir
+	config.Store = newMemoryStore()
+	config.MasterKey = testMasterKey
+	config.HTTPClient = &MockClient{}
+	return config
+}
+
 func init() {
-	Client = &MockClient{}
+	// The suite can run against PostgreSQL instead of SQLite
+	config := testConfig("./data")
+	config.Database = getenv("ROBOKACHE_DATABASE", config.Database)
+	config.DatabaseURL = os.Getenv("ROBOKACHE_DATABASE_URL")
+	var err error
+	srv, err = New(config)
+	fatal(err)
+	fatal(srv.SetupDB())
 
 	signBytes, err := os.ReadFile(privKeyPath)
 	fatal(err)
@@ -83,7 +131,7 @@ func init() {
 
 	gin.SetMode(gin.TestMode)
 	// Grab our router
-	router = SetupRouter()
+	router = srv.SetupRouter()
 
 	type MyCustomClaims struct {
 		Email string `json:"https://qgraph.org/email,omitempty"`
@@ -106,10 +154,10 @@ func init() {
 
 // Ensure that we don't have failing setup functions
 func TestSetupFunctions(t *testing.T) {
-	err := clearDB()
+	err := srv.clearDB()
 	assert.Nil(t, err)
 
-	err = loadSampleData()
+	err = srv.loadSampleData()
 	assert.Nil(t, err)
 }
 
@@ -132,8 +180,8 @@ func TestGetWithMalformedBearer(t *testing.T) {
 }
 
 func TestGetDocumentsNotLoggedIn(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	w := performRequest(router, "GET", "/api/document", nil, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -147,8 +195,8 @@ func TestGetDocumentsNotLoggedIn(t *testing.T) {
 }
 
 func TestGetDocuments(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	w := performRequest(router, "GET", "/api/document", &signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -162,8 +210,8 @@ func TestGetDocuments(t *testing.T) {
 }
 
 func TestGetDocumentsNoParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Gets root documents
 	w := performRequest(router, "GET", "/api/document?has_parent=false", &signedString, nil)
@@ -181,8 +229,8 @@ func TestGetDocumentsNoParent(t *testing.T) {
 }
 
 func TestGetDocumentsHasParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Gets root documents
 	w := performRequest(router, "GET", "/api/document?has_parent=true", &signedString, nil)
@@ -200,11 +248,11 @@ func TestGetDocumentsHasParent(t *testing.T) {
 }
 
 func TestGetMePrivateDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Can get my own private document
-	hashedID, _ := idToHash(0)
+	hashedID, _ := srv.ids.idToHash(0)
 	w := performRequest(router, "GET", "/api/document/"+hashedID, &signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -217,10 +265,10 @@ func TestGetMePrivateDocument(t *testing.T) {
 }
 
 func TestGetYouPrivateDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	hashedID, err := idToHash(6)
+	hashedID, err := srv.ids.idToHash(6)
 	assert.Nil(t, err)
 	w := performRequest(router, "GET", "/api/document/"+hashedID, &signedString, nil)
 	fmt.Println(w.Code)
@@ -229,11 +277,11 @@ func TestGetYouPrivateDocument(t *testing.T) {
 }
 
 func TestGetYouShareableDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Can get other's shareable documents
-	hashedID, err := idToHash(5)
+	hashedID, err := srv.ids.idToHash(5)
 	assert.Nil(t, err)
 	w := performRequest(router, "GET", "/api/document/"+hashedID, &signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -246,10 +294,10 @@ func TestGetYouShareableDocument(t *testing.T) {
 }
 
 func TestGetPublicDocumentNotLoggedIn(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	hashedID, err := idToHash(3)
+	hashedID, err := srv.ids.idToHash(3)
 	assert.Nil(t, err)
 	// Can get public document
 	w := performRequest(router, "GET", "/api/document/"+hashedID, nil, nil)
@@ -261,10 +309,10 @@ func TestGetPublicDocumentNotLoggedIn(t *testing.T) {
 }
 
 func TestGetShareableDocumentNotLoggedIn(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	hashedID, err := idToHash(1)
+	hashedID, err := srv.ids.idToHash(1)
 	assert.Nil(t, err)
 	// Can get shareable documents
 	w := performRequest(router, "GET", "/api/document/"+hashedID, nil, nil)
@@ -276,10 +324,10 @@ func TestGetShareableDocumentNotLoggedIn(t *testing.T) {
 }
 
 func TestGetPrivateDocumentNotLoggedIn(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	hashedID, err := idToHash(0)
+	hashedID, err := srv.ids.idToHash(0)
 	assert.Nil(t, err)
 	// Cannot get private documents
 	w := performRequest(router, "GET", "/api/document/"+hashedID, nil, nil)
@@ -287,11 +335,11 @@ func TestGetPrivateDocumentNotLoggedIn(t *testing.T) {
 }
 
 func TestGetChildren(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Can see all of my own child documents
-	hashedID, _ := idToHash(1)
+	hashedID, _ := srv.ids.idToHash(1)
 	w := performRequest(router, "GET", "/api/document/"+hashedID+"/children", &signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
 	var response []map[string]interface{}
@@ -300,7 +348,7 @@ func TestGetChildren(t *testing.T) {
 	assert.Equal(t, 2, len(response))
 
 	// Can see public and shareable child documents if the document is not owned by me
-	hashedID, _ = idToHash(5)
+	hashedID, _ = srv.ids.idToHash(5)
 	assert.Nil(t, err)
 	w = performRequest(router, "GET", "/api/document/"+hashedID+"/children", &signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
@@ -310,20 +358,20 @@ func TestGetChildren(t *testing.T) {
 }
 
 func TestGetChildrenPrivateDoc(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Can't view other users' child documents
-	hashedID, _ := idToHash(6)
+	hashedID, _ := srv.ids.idToHash(6)
 	w := performRequest(router, "GET", "/api/document/"+hashedID+"/children", &signedString, nil)
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
 func TestGetPutData(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 	requestBody := "This is a string to test the data saving functionality"
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s/data`, id),
@@ -337,11 +385,595 @@ func TestGetPutData(t *testing.T) {
 	assert.Equal(t, requestBody, w.Body.String())
 }
 
+func TestGetDataRange(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "0123456789abcdefghij"
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "20", w.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+
+	// Resume a download part way through
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil,
+		map[string]string{"Range": "bytes=10-"})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "bytes 10-19/20", w.Header().Get("Content-Range"))
+	assert.Equal(t, "abcdefghij", w.Body.String())
+}
+
+func TestGetDataConditional(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(3)
+	requestBody := "Public data that can be cached"
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, no-cache", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEqual(t, "", etag)
+	assert.NotEqual(t, "", lastModified)
+
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), nil, nil,
+		map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), nil, nil,
+		map[string]string{"If-Modified-Since": lastModified})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// New data invalidates the cached copy
+	newBody := "Public data that has changed"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &newBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), nil, nil,
+		map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, newBody, w.Body.String())
+}
+
+func TestGetDataCompressed(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := strings.Repeat("TRAPI JSON compresses well. ", 100)
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The data is stored compressed
+	var stored struct {
+		SHA256   string `db:"sha256"`
+		Encoding string `db:"encoding"`
+	}
+	err := srv.db.Get(&stored, `SELECT sha256, encoding FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, gzipEncoding, stored.Encoding)
+	info, err := srv.store.Stat(blobKey(stored.SHA256))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size, int64(len(requestBody)))
+
+	// Clients that accept gzip get the compressed data
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil,
+		map[string]string{"Accept-Encoding": "gzip, deflate"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, `"`+stored.SHA256+`-gzip"`, w.Header().Get("ETag"))
+	zr, err := gzip.NewReader(w.Body)
+	assert.Nil(t, err)
+	decompressed, err := io.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(decompressed))
+
+	// Everyone else gets it decompressed
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil,
+		map[string]string{"Accept-Encoding": "gzip;q=0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, fmt.Sprint(len(requestBody)), w.Header().Get("Content-Length"))
+	assert.Equal(t, requestBody, w.Body.String())
+}
+
+func TestPutDataCompressed(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "This data was compressed by the client"
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(requestBody))
+	zw.Close()
+	compressedBody := compressed.String()
+
+	w := performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &compressedBody,
+		map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+
+	// Bodies that aren't gzip are rejected
+	w = performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody,
+		map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody,
+		map[string]string{"Content-Encoding": "br"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// An interrupted upload is reported and keeps the previous data
+func TestPutDataInterrupted(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "This is the data that should be kept"
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The body breaks off after a few bytes like a dropped connection
+	body := io.MultiReader(strings.NewReader("This is the da"),
+		iotest.ErrReader(io.ErrUnexpectedEOF))
+	req, _ := http.NewRequest("PUT", fmt.Sprintf(`/api/document/%s/data`, id), body)
+	req.Header.Add("Authorization", "Bearer "+signedString)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, requestBody, w.Body.String())
+
+	// Nothing is left behind in staging
+	memStore := srv.store.(*memoryStore)
+	for key := range memStore.blobs {
+		assert.False(t, strings.HasPrefix(key, "staging/"))
+	}
+}
+
+// Data can be sent in several requests, resuming after interruptions
+func TestResumableUpload(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	w := performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/data/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "20"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	location := w.Header().Get("Location")
+	assert.Equal(t, "/api/uploads/"+response["id"].(string), location)
+
+	// The first request breaks off part way through
+	body := io.MultiReader(strings.NewReader("01234"),
+		iotest.ErrReader(io.ErrUnexpectedEOF))
+	req, _ := http.NewRequest("PATCH", location, body)
+	req.Header.Add("Authorization", "Bearer "+signedString)
+	req.Header.Add("Upload-Offset", "0")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Ask where to resume
+	w = performRequest(router, "HEAD", location, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Upload-Offset"))
+	assert.Equal(t, "20", w.Header().Get("Upload-Length"))
+
+	// Sending from the wrong offset is rejected
+	chunk := "56789"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "5"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Upload-Offset"))
+
+	// Sending more than Upload-Length is rejected
+	chunk = "abcdefghijk"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "10"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The last chunk stores the data with the document
+	chunk = "abcdefghij"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "10"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, id, response["id"])
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, "0123456789abcdefghij", w.Body.String())
+
+	// The finished upload and its chunks are gone
+	w = performRequest(router, "GET", location, &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	memStore := srv.store.(*memoryStore)
+	for key := range memStore.blobs {
+		assert.False(t, strings.HasPrefix(key, "uploads/"))
+	}
+}
+
+func TestResumableUploadChild(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	w := performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "10"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+
+	// Only the user who started the upload can use it
+	w = performRequest(router, "GET", location, nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	chunk := "0123456789"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	childID := response["id"].(string)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s`, childID), &signedString, nil)
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, id, response["parent"])
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, childID), &signedString, nil)
+	assert.Equal(t, chunk, w.Body.String())
+
+	// Can't upload to documents that aren't mine
+	id, _ = srv.ids.idToHash(4)
+	w = performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "10"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestResumableUploadRetry(t *testing.T) {
+	defer func(size int64) { srv.config.MaxDataSize = size }(srv.config.MaxDataSize)
+	srv.clearDB()
+	srv.loadSampleData()
+
+	// An empty upload is finished by an empty request
+	id, _ := srv.ids.idToHash(1)
+	w := performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "0"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	empty := ""
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &empty,
+		map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, response["id"]), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	// An upload that couldn't be stored can be finished later
+	w = performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/data/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "10"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location = w.Header().Get("Location")
+	chunk := "01234"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	srv.config.MaxDataSize = 5
+	chunk = "56789"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "5"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	srv.config.MaxDataSize = 0
+
+	// Nothing more can be added to it
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "10"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &empty,
+		map[string]string{"Upload-Offset": "5"})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &empty,
+		map[string]string{"Upload-Offset": "10"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, id, response["id"])
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, "0123456789", w.Body.String())
+	w = performRequest(router, "GET", location, &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDataContentType(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := `{"message": {}}`
+	w := performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data?filename=results/answer.json`, id),
+		&signedString, &requestBody,
+		map[string]string{"Content-Type": "application/json; charset=utf-8"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s`, id), &signedString, nil)
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/json; charset=utf-8", response["content_type"])
+	assert.Equal(t, "answer.json", response["filename"])
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "inline; filename=answer.json", w.Header().Get("Content-Disposition"))
+
+	// New data without a content type replaces the old one
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "", w.Header().Get("Content-Disposition"))
+
+	w = performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody,
+		map[string]string{"Content-Type": "not a/media type"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Resumable uploads have their content type in a separate header
+	w = performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children/uploads?filename=answer.json`, id),
+		&signedString, nil, map[string]string{
+			"Upload-Length":       strconv.Itoa(len(requestBody)),
+			"Upload-Content-Type": "application/json",
+		})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = performRequestWithHeaders(router, "PATCH", w.Header().Get("Location"),
+		&signedString, &requestBody, map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, response["id"]), &signedString, nil)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "inline; filename=answer.json", w.Header().Get("Content-Disposition"))
+}
+
+func TestDataDigest(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "hello"
+	reprDigest, legacyDigest := formatSHA256Digest(
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	w := performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody,
+		map[string]string{"Repr-Digest": reprDigest})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s`, id), &signedString, nil)
+	var response map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", response["data_sha256"])
+	assert.Equal(t, float64(len(requestBody)), response["data_size"])
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+	assert.Equal(t, reprDigest, w.Header().Get("Repr-Digest"))
+	assert.Equal(t, legacyDigest, w.Header().Get("Digest"))
+
+	// The digest of the decompressed data doesn't describe gzip responses
+	w = performRequestWithHeaders(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil,
+		map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "", w.Header().Get("Repr-Digest"))
+
+	// Data that doesn't match its digest is rejected and not stored
+	otherBody := "goodbye"
+	w = performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &otherBody,
+		map[string]string{"Digest": legacyDigest})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+	var blobs int
+	err = srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, blobs)
+}
+
+func TestDataRevisions(t *testing.T) {
+	defer func(limit int) { srv.config.DataRevisions = limit }(srv.config.DataRevisions)
+	srv.config.DataRevisions = 2
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	versions := []string{"first version", "second version", "third version", "fourth version"}
+	for _, version := range versions {
+		w := performRequest(router, "PUT",
+			fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &version)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// Only the two versions before the current one are kept
+	w := performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var revisions []map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &revisions)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	var blobs int
+	err = srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, blobs)
+
+	second := fmt.Sprintf(`/api/document/%s/data/revisions/%v`, id, revisions[1]["id"])
+	w = performRequest(router, "GET", second, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, versions[1], w.Body.String())
+
+	// Restoring makes the revision current and keeps the replaced data
+	w = performRequest(router, "POST", second+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, versions[1], w.Body.String())
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions`, id), &signedString, nil)
+	err = json.Unmarshal(w.Body.Bytes(), &revisions)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	assert.Equal(t, "4c46afd3248b71d03cfc4e0ff693244cad02c2a5e0cfc1cb105de4c6b3cae78a", revisions[0]["data_sha256"])
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions/12345`, id), &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Revisions belong to their document
+	other, _ := srv.ids.idToHash(0)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions/%v`, other, revisions[0]["id"]), &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Purging the document deletes its revisions
+	w = performRequest(router, "DELETE",
+		fmt.Sprintf(`/api/document/%s?recursive=true`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "DELETE",
+		fmt.Sprintf(`/api/trash/%s`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	err = srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, blobs)
+}
+
+func TestDocumentRevisions(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(0)
+	parentID, _ := srv.ids.idToHash(1)
+	edits := []string{
+		`{ "metadata" : { "name" : "first" } }`,
+		fmt.Sprintf(`{ "parent" : "%s", "metadata" : { "name" : "second" } }`, parentID),
+	}
+	for _, edit := range edits {
+		w := performRequest(router, "PUT", "/api/document/"+id, &signedString, &edit)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := performRequest(router, "GET", "/api/document/"+id+"/revisions", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var revisions []map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &revisions)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	latest := revisions[0]
+	assert.Equal(t, "me@robokache.com", latest["editor"])
+	assert.Equal(t, "", latest["old"].(map[string]interface{})["parent"])
+	assert.Equal(t, parentID, latest["new"].(map[string]interface{})["parent"])
+	assert.Equal(t, map[string]interface{}{"name": "first"},
+		latest["old"].(map[string]interface{})["metadata"])
+
+	// Reverting the latest edit moves the document back to the root
+	w = performRequest(router, "POST",
+		fmt.Sprintf("/api/document/%s/revisions/%v/revert", id, latest["id"]), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET", "/api/document/"+id, &signedString, nil)
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Nil(t, err)
+	assert.Equal(t, "", response["parent"])
+	assert.Equal(t, map[string]interface{}{"name": "first"}, response["metadata"])
+
+	w = performRequest(router, "GET", "/api/document/"+id+"/revisions", &signedString, nil)
+	err = json.Unmarshal(w.Body.Bytes(), &revisions)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(revisions))
+
+	w = performRequest(router, "POST",
+		fmt.Sprintf("/api/document/%s/revisions/12345/revert", id), &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Only the owner can see the revisions
+	other, _ := srv.ids.idToHash(4)
+	w = performRequest(router, "GET", "/api/document/"+other+"/revisions", &signedString, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
 func TestGetNoData(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 	w := performRequest(router, "GET",
 		fmt.Sprintf(`/api/document/%s/data`, id),
 		&signedString, nil)
@@ -350,10 +982,65 @@ func TestGetNoData(t *testing.T) {
 	assert.Equal(t, "", w.Body.String())
 }
 
+// Identical data is only stored once and removed once nothing refers to it
+func TestPutDataDeduplicated(t *testing.T) {
+	// Without revisions replaced data is deleted right away
+	defer func(limit int) { srv.config.DataRevisions = limit }(srv.config.DataRevisions)
+	srv.config.DataRevisions = 0
+	srv.clearDB()
+	srv.loadSampleData()
+
+	requestBody := "This data is shared by two documents"
+	for _, i := range []int{1, 2} {
+		id, _ := srv.ids.idToHash(i)
+		w := performRequest(router, "PUT",
+			fmt.Sprintf(`/api/document/%s/data`, id),
+			&signedString, &requestBody)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var blobs []struct {
+		SHA256 string `db:"sha256"`
+		Size   int64  `db:"size"`
+		Refs   int    `db:"refs"`
+	}
+	err := srv.db.Select(&blobs, `SELECT sha256, size, refs FROM blob`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blobs))
+	assert.Equal(t, 2, blobs[0].Refs)
+	assert.Equal(t, int64(len(requestBody)), blobs[0].Size)
+	digest := blobs[0].SHA256
+
+	// Purging one document keeps the data for the other
+	id, _ := srv.ids.idToHash(2)
+	w := performRequest(router, "DELETE",
+		fmt.Sprintf(`/api/document/%s`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "DELETE",
+		fmt.Sprintf(`/api/trash/%s`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = srv.store.Stat(blobKey(digest))
+	assert.Nil(t, err)
+
+	// Replacing the data of the last document removes the blob
+	id, _ = srv.ids.idToHash(1)
+	newBody := "This data replaces the shared data"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id),
+		&signedString, &newBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err = srv.store.Stat(blobKey(digest))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, newBody, w.Body.String())
+}
+
 // Check that we can post an empty document and it is valid
 func TestPostEmpty(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	requestBody := `{}`
 	w := performRequest(router, "POST", "/api/document", &signedString, &requestBody)
@@ -364,7 +1051,7 @@ func TestPostEmpty(t *testing.T) {
 
 	newDocumentIDHash := response["id"].(string)
 
-	newDocumentID, err := hashToID(newDocumentIDHash)
+	newDocumentID, err := srv.ids.hashToID(newDocumentIDHash)
 	assert.Nil(t, err)
 	assert.Greater(t, newDocumentID, 8)
 
@@ -381,8 +1068,8 @@ func TestPostEmpty(t *testing.T) {
 
 // Check that we get 401 error on POST route when not logged in
 func TestPostNotLoggedIn(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	requestBody := `{ "visibility" : 4 }`
 	w := performRequest(router, "POST", "/api/document", nil, &requestBody)
@@ -391,10 +1078,10 @@ func TestPostNotLoggedIn(t *testing.T) {
 
 // Test the shortcut route to add a child with data
 func TestPostChildWithData(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 	requestBody := "This is a string to test the data saving functionality"
 	w := performRequest(router, "POST",
 		fmt.Sprintf(`/api/document/%s/children`, id),
@@ -408,7 +1095,7 @@ func TestPostChildWithData(t *testing.T) {
 	newDocumentIDHash := response["id"].(string)
 	log.Println(newDocumentIDHash)
 
-	newDocumentID, err := hashToID(newDocumentIDHash)
+	newDocumentID, err := srv.ids.hashToID(newDocumentIDHash)
 	assert.Nil(t, err)
 	assert.Greater(t, newDocumentID, 8)
 
@@ -429,9 +1116,40 @@ func TestPostChildWithData(t *testing.T) {
 	assert.Equal(t, requestBody, w.Body.String())
 }
 
+// A child whose data can't be stored is not created
+func TestPostChildWithFailedData(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	before, err := srv.GetUsage("me@robokache.com")
+	assert.Nil(t, err)
+
+	id, _ := srv.ids.idToHash(1)
+	_, digest := formatSHA256Digest(
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824")
+	requestBody := "not hello"
+	w := performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children`, id), &signedString, &requestBody,
+		map[string]string{"Digest": digest})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Or when it is over the quota
+	defer func(bytes int64) { srv.config.ByteQuota = bytes }(srv.config.ByteQuota)
+	srv.config.ByteQuota = 5
+	w = performRequest(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	after, err := srv.GetUsage("me@robokache.com")
+	assert.Nil(t, err)
+	assert.Equal(t, before.Documents, after.Documents)
+	var blobs int
+	assert.Nil(t, srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`))
+	assert.Equal(t, 0, blobs)
+}
+
 func TestPostDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 	requestBody := `{ "visibility" : 4 }`
 	w := performRequest(router, "POST", "/api/document", &signedString, &requestBody)
 	assert.Equal(t, http.StatusCreated, w.Code)
@@ -441,14 +1159,14 @@ func TestPostDocument(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Check that the ID was returned
-	createdID, err := hashToID(response["id"].(string))
+	createdID, err := srv.ids.hashToID(response["id"].(string))
 	assert.Nil(t, err)
 	assert.Greater(t, createdID, 8)
 }
 
 func TestPostDocumentWithMetadata(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	metadata := map[string]interface{}{
 		"hasAnswers":   true,
@@ -479,10 +1197,10 @@ func TestPostDocumentWithMetadata(t *testing.T) {
 }
 
 func TestPostDocumentWithParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	parentID, _ := idToHash(1)
+	parentID, _ := srv.ids.idToHash(1)
 	requestBody := fmt.Sprintf(
 		`{ "parent" : "%s", "visibility" : %d }`,
 		parentID, shareable)
@@ -494,17 +1212,17 @@ func TestPostDocumentWithParent(t *testing.T) {
 	assert.Nil(t, err)
 
 	// Check that the ID was returned
-	createdID, err := hashToID(response["id"].(string))
+	createdID, err := srv.ids.hashToID(response["id"].(string))
 	assert.Nil(t, err)
 	assert.Greater(t, createdID, 8)
 }
 
 func TestPostDocumentInvalidParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Parent document is not owned by me
-	parentID, _ := idToHash(4)
+	parentID, _ := srv.ids.idToHash(4)
 	requestBody := fmt.Sprintf(
 		`{ "parent" : "%s", "visibility" : %d }`,
 		parentID, shareable)
@@ -512,7 +1230,7 @@ func TestPostDocumentInvalidParent(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	// Parent document has less visibility
-	parentID, _ = idToHash(0)
+	parentID, _ = srv.ids.idToHash(0)
 	requestBody = fmt.Sprintf(
 		`{ "parent" : "%s", "visibility" : %d }`,
 		parentID, shareable)
@@ -521,11 +1239,11 @@ func TestPostDocumentInvalidParent(t *testing.T) {
 }
 
 func TestPutDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	requestBody := fmt.Sprintf(`{ "visibility" : %d }`, private)
-	idHash, _ := idToHash(1)
+	idHash, _ := srv.ids.idToHash(1)
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, idHash),
 		&signedString, &requestBody)
@@ -533,11 +1251,11 @@ func TestPutDocument(t *testing.T) {
 }
 
 func TestPutDocumentNotOwned(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	requestBody := fmt.Sprintf(`{ "visibility" : %d }`, private)
-	idHash, _ := idToHash(4)
+	idHash, _ := srv.ids.idToHash(4)
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, idHash),
 		&signedString, &requestBody)
@@ -545,11 +1263,11 @@ func TestPutDocumentNotOwned(t *testing.T) {
 }
 
 func TestPutDocumentNotVisible(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	requestBody := fmt.Sprintf(`{ "visibility" : %d }`, private)
-	idHash, _ := idToHash(6)
+	idHash, _ := srv.ids.idToHash(6)
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, idHash),
 		&signedString, &requestBody)
@@ -557,13 +1275,13 @@ func TestPutDocumentNotVisible(t *testing.T) {
 }
 
 func TestPutDocumentModifyParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	newParentID, _ := idToHash(0)
+	newParentID, _ := srv.ids.idToHash(0)
 	requestBody := fmt.Sprintf(`{ "parent" : "%s", "visibility" : %d }`,
 		newParentID, private)
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, &requestBody)
@@ -571,31 +1289,31 @@ func TestPutDocumentModifyParent(t *testing.T) {
 }
 
 func TestPutDocumentInvalidParent(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
 	// Not enough visibility on parent
-	newParentID, _ := idToHash(0)
+	newParentID, _ := srv.ids.idToHash(0)
 	requestBody := fmt.Sprintf(`{ "parent" : "%s" }`, newParentID)
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 	w := performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, &requestBody)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	// Not owned by current user
-	newParentID, _ = idToHash(5)
+	newParentID, _ = srv.ids.idToHash(5)
 	requestBody = fmt.Sprintf(`{ "parent" : "%s" }`, newParentID)
-	id, _ = idToHash(1)
+	id, _ = srv.ids.idToHash(1)
 	w = performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, &requestBody)
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 
 	// Doesn't exist
-	newParentID, _ = idToHash(45)
+	newParentID, _ = srv.ids.idToHash(45)
 	requestBody = fmt.Sprintf(`{ "parent" : "%s" }`, newParentID)
-	id, _ = idToHash(1)
+	id, _ = srv.ids.idToHash(1)
 	w = performRequest(router, "PUT",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, &requestBody)
@@ -603,23 +1321,77 @@ func TestPutDocumentInvalidParent(t *testing.T) {
 }
 
 func TestDeleteDocument(t *testing.T) {
-	clearDB()
-	loadSampleData()
+	srv.clearDB()
+	srv.loadSampleData()
 
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(2)
 	w := performRequest(router, "DELETE",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, nil)
 	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"deleted": ["%s"]}`, id), w.Body.String())
 
 	// Can't delete other user's document
-	id, _ = idToHash(4)
+	id, _ = srv.ids.idToHash(4)
 	w = performRequest(router, "DELETE",
 		fmt.Sprintf(`/api/document/%s`, id),
 		&signedString, nil)
 	assert.Equal(t, http.StatusForbidden, w.Code)
 }
 
+func TestDeleteDocumentWithChildren(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	// Give the question an answer with data below its children
+	question, _ := srv.ids.idToHash(1)
+	child, _ := srv.ids.idToHash(3)
+	requestBody := "An answer"
+	w := performRequest(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children`, child), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var created map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	answerID, _ := srv.ids.hashToID(created["id"])
+	var digest string
+	assert.Nil(t, srv.db.Get(&digest, `SELECT data_sha256 FROM document WHERE id=?`, answerID))
+
+	// Documents with children are kept unless deleted recursively
+	w = performRequest(router, "DELETE", "/api/document/"+question, &signedString, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = performRequest(router, "GET", "/api/document/"+question, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "DELETE", "/api/document/"+question+"?recursive=true", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string][]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	other, _ := srv.ids.idToHash(2)
+	assert.ElementsMatch(t, []string{question, other, child, created["id"]}, response["deleted"])
+
+	for _, id := range response["deleted"] {
+		w = performRequest(router, "GET", "/api/document/"+id, &signedString, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	// Purging them deletes their data
+	w = performRequest(router, "DELETE", "/api/trash/"+question, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.ElementsMatch(t, []string{question, other, child, created["id"]}, response["deleted"])
+	var blobs int
+	assert.Nil(t, srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`))
+	assert.Equal(t, 0, blobs)
+	_, err := srv.store.Stat(blobKey(digest))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Other documents are left alone
+	w = performRequest(router, "GET", "/api/document", &signedString, nil)
+	var documents []Document
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &documents))
+	assert.Len(t, documents, 3)
+}
+
 // Benchmark to test how the application handles large files
 func BenchmarkGetPutLargeData(b *testing.B) {
 	var testBytes []byte
@@ -634,11 +1406,11 @@ func BenchmarkGetPutLargeData(b *testing.B) {
 	}
 	testString = string(testBytes)
 
-	id, _ := idToHash(1)
+	id, _ := srv.ids.idToHash(1)
 
 	// Repeat benchmark to get accurate timing data
 	for i := 0; i < b.N; i++ {
-		loadSampleData()
+		srv.loadSampleData()
 		b.StartTimer()
 
 		performRequest(router, "PUT",
@@ -649,6 +1421,182 @@ func BenchmarkGetPutLargeData(b *testing.B) {
 			&signedString, nil)
 
 		b.StopTimer()
-		clearDB()
+		srv.clearDB()
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	defer func(documents int, bytes int64) {
+		srv.config.DocumentQuota, srv.config.ByteQuota = documents, bytes
+	}(srv.config.DocumentQuota, srv.config.ByteQuota)
+	srv.config.DocumentQuota, srv.config.ByteQuota = 5, 20
+	srv.clearDB()
+	srv.loadSampleData()
+
+	// Four of the sample documents are mine
+	w := performRequest(router, "GET", "/api/usage", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var usage map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &usage)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"documents": float64(4), "bytes": float64(0),
+		"document_quota": float64(5), "byte_quota": float64(20),
+	}, usage)
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "0123456789"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// Replaced data counts while it is kept as a revision
+	requestBody = "0123456789abcdef"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	defer func(limit int) { srv.config.DataRevisions = limit }(srv.config.DataRevisions)
+	srv.config.DataRevisions = 0
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Data over the quota is rejected and the document keeps its data
+	other, _ := srv.ids.idToHash(2)
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, other), &signedString, &requestBody)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "quota of 20 bytes")
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, other), &signedString, nil)
+	assert.Equal(t, "", w.Body.String())
+
+	// So are uploads that would go over it
+	w = performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/data/uploads`, other), &signedString, nil,
+		map[string]string{"Upload-Length": "5"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "GET", "/api/usage", &signedString, nil)
+	err = json.Unmarshal(w.Body.Bytes(), &usage)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(len(requestBody)), usage["bytes"])
+
+	// One more document fits
+	newDoc := `{}`
+	w = performRequest(router, "POST", "/api/document", &signedString, &newDoc)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = performRequest(router, "POST", "/api/document", &signedString, &newDoc)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "quota of 5 documents")
+}
+
+// Earlier data kept as revisions counts against the byte quota
+func TestRevisionQuota(t *testing.T) {
+	defer func(bytes int64, limit int) {
+		srv.config.ByteQuota, srv.config.DataRevisions = bytes, limit
+	}(srv.config.ByteQuota, srv.config.DataRevisions)
+	srv.config.ByteQuota, srv.config.DataRevisions = 20, 2
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id := hashOf(1)
+	for _, version := range []string{"0123456789", "abcde"} {
+		w := performRequest(router, "PUT",
+			fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &version)
+		assert.Equal(t, http.StatusOK, w.Code)
 	}
+	w := performRequest(router, "GET", "/api/usage", &signedString, nil)
+	var usage Usage
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &usage))
+	assert.Equal(t, int64(15), usage.Bytes)
+
+	requestBody := "abcdef"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, hashOf(2)), &signedString, &requestBody)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Restoring keeps the current data as a revision too
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions`, id), &signedString, nil)
+	var revisions []DataRevision
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	assert.Len(t, revisions, 1)
+	restore := fmt.Sprintf(`/api/document/%s/data/revisions/%d/restore`, id, revisions[0].ID)
+	w = performRequest(router, "POST", restore, &signedString, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "quota of 20 bytes")
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, "abcde", w.Body.String())
+
+	srv.config.ByteQuota = 25
+	w = performRequest(router, "POST", restore, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, "0123456789", w.Body.String())
+}
+
+func TestSizeLimits(t *testing.T) {
+	defer func(data, document int64) {
+		srv.config.MaxDataSize, srv.config.MaxDocumentSize = data, document
+	}(srv.config.MaxDataSize, srv.config.MaxDocumentSize)
+	srv.config.MaxDataSize, srv.config.MaxDocumentSize = 10, 20
+	srv.clearDB()
+	srv.loadSampleData()
+
+	id, _ := srv.ids.idToHash(1)
+	requestBody := "0123456789"
+	w := performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Data that says it is too large is rejected before it is read
+	tooLarge := "0123456789a"
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &tooLarge)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "at most 10 bytes")
+
+	// Compressed data is limited while it is decompressed
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(strings.Repeat("a", 1000)))
+	zw.Close()
+	compressedBody := compressed.String()
+	w = performRequestWithHeaders(router, "PUT",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &compressedBody,
+		map[string]string{"Content-Encoding": "gzip"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, requestBody, w.Body.String())
+
+	// So are children and uploads
+	w = performRequest(router, "POST",
+		fmt.Sprintf(`/api/document/%s/children`, id), &signedString, &tooLarge)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/data/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "11"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// And JSON documents
+	newDoc := `{"metadata": {}}`
+	w = performRequest(router, "POST", "/api/document", &signedString, &newDoc)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	newDoc = `{"metadata": {"name": "too long"}}`
+	w = performRequest(router, "POST", "/api/document", &signedString, &newDoc)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "at most 20 bytes")
+	// Even when they don't say how long they are
+	req, _ := http.NewRequest("POST", "/api/document",
+		io.NopCloser(strings.NewReader(newDoc)))
+	req.Header.Add("Authorization", "Bearer "+signedString)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = performRequest(router, "PUT",
+		fmt.Sprintf(`/api/document/%s`, id), &signedString, &newDoc)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
 }
@@ -0,0 +1,324 @@
+package robokache
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The schema is built by migrations that are applied in order. Every applied
+// migration is recorded in the schema_version table. Migrations that existed
+// before that table did are written so that they can run again on a database
+// that already has their changes. They are written for SQLite, and their
+// column types are translated for PostgreSQL.
+
+// Migration is a change to the database schema
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *transaction) error
+}
+
+var migrations = []Migration{
+	{1, "Create document table", execMigration(`
+		CREATE TABLE IF NOT EXISTS document (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent INTEGER,
+			owner TEXT,
+			visibility INTEGER,
+			metadata TEXT,
+			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp
+		);`)},
+	{2, "Store document data as blobs", func(tx *transaction) error {
+		err := execMigration(`
+			CREATE TABLE IF NOT EXISTS blob (
+				sha256 TEXT PRIMARY KEY,
+				size INTEGER NOT NULL,
+				refs INTEGER NOT NULL
+			);`)(tx)
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "document", "data_sha256", "TEXT")
+		if err != nil {
+			return err
+		}
+		return addColumn(tx, "document", "data_updated_at", "TIMESTAMP")
+	}},
+	{3, "Record how blobs are compressed", func(tx *transaction) error {
+		return addColumn(tx, "blob", "encoding", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{4, "Add resumable uploads", execMigration(`
+		CREATE TABLE IF NOT EXISTS upload (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL,
+			document INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			length INTEGER NOT NULL,
+			received INTEGER NOT NULL,
+			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp
+		);
+		CREATE TABLE IF NOT EXISTS upload_chunk (
+			upload TEXT NOT NULL,
+			start INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			key TEXT NOT NULL
+		);`)},
+	{5, "Store wrapped data keys", func(tx *transaction) error {
+		for _, table := range []string{"blob", "upload"} {
+			err := addColumn(tx, table, "key_id", "TEXT")
+			if err != nil {
+				return err
+			}
+			err = addColumn(tx, table, "wrapped_key", "BLOB")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{6, "Record content types and file names", func(tx *transaction) error {
+		err := addColumn(tx, "document", "content_type", "TEXT")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "document", "filename", "TEXT")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "upload", "content_type", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		return addColumn(tx, "upload", "filename", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{7, "Record data sizes and expected digests", func(tx *transaction) error {
+		err := addColumn(tx, "upload", "sha256", "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "document", "data_size", "INTEGER")
+		if err != nil {
+			return err
+		}
+		// Fill in sizes of data stored before they were recorded on documents
+		_, err = tx.Exec(`
+			UPDATE document SET data_size=(SELECT size FROM blob WHERE sha256=data_sha256)
+			WHERE data_sha256 IS NOT NULL AND data_size IS NULL
+		`)
+		return err
+	}},
+	{8, "Add data revisions", execMigration(`
+		CREATE TABLE IF NOT EXISTS data_revision (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document INTEGER NOT NULL,
+			data_sha256 TEXT NOT NULL,
+			data_size INTEGER,
+			content_type TEXT,
+			filename TEXT,
+			created_at TIMESTAMP NOT NULL
+		);`)},
+	{9, "Add document revisions", execMigration(`
+		CREATE TABLE IF NOT EXISTS document_revision (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document INTEGER NOT NULL,
+			editor TEXT NOT NULL,
+			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp,
+			old_parent INTEGER,
+			old_visibility INTEGER,
+			old_metadata TEXT,
+			new_parent INTEGER,
+			new_visibility INTEGER,
+			new_metadata TEXT
+		);`)},
+	{10, "Index documents, revisions and chunks", execMigration(`
+		CREATE INDEX document_owner ON document (owner);
+		CREATE INDEX document_parent ON document (parent);
+		CREATE INDEX data_revision_document ON data_revision (document);
+		CREATE INDEX document_revision_document ON document_revision (document);
+		CREATE INDEX upload_chunk_upload ON upload_chunk (upload);`)},
+	{11, "Add the trash", func(tx *transaction) error {
+		err := addColumn(tx, "document", "deleted_at", "TIMESTAMP")
+		if err != nil {
+			return err
+		}
+		err = addColumn(tx, "document", "deleted_with", "INTEGER")
+		if err != nil {
+			return err
+		}
+		return execMigration(`CREATE INDEX document_deleted_with ON document (deleted_with);`)(tx)
+	}},
+	{12, "Record finished setup tasks", execMigration(`
+		CREATE TABLE IF NOT EXISTS setup_task (
+			name TEXT PRIMARY KEY,
+			finished_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp
+		);`)},
+	{13, "Claim uploads while they are finished", func(tx *transaction) error {
+		return addColumn(tx, "upload", "finishing_at", "TIMESTAMP")
+	}},
+}
+
+// postgresTypes translates the SQLite column types of migrations
+var postgresTypes = strings.NewReplacer(
+	"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+	"INTEGER", "BIGINT",
+	"TIMESTAMP", "TIMESTAMPTZ",
+	"BLOB", "BYTEA",
+	"metadata TEXT", "metadata JSONB",
+)
+
+// schemaSQL translates statements that change the schema for PostgreSQL if needed
+func schemaSQL(postgres bool, statements string) string {
+	if postgres {
+		return postgresTypes.Replace(statements)
+	}
+	return statements
+}
+
+// execMigration is a migration that only runs SQL statements
+func execMigration(statements string) func(tx *transaction) error {
+	return func(tx *transaction) error {
+		_, err := tx.Exec(schemaSQL(tx.isPostgres(), statements))
+		return err
+	}
+}
+
+// addColumn adds a column to a table unless it already has it
+func addColumn(tx *transaction, table string, column string, definition string) error {
+	if tx.isPostgres() {
+		_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`,
+			table, column, schemaSQL(true, definition)))
+		return err
+	}
+	var columns []struct {
+		Name string `db:"name"`
+	}
+	err := tx.Select(&columns, `SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if c.Name == column {
+			return nil
+		}
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+// SchemaVersion is the version of the last migration applied to the database
+func (s *Server) SchemaVersion() (int, error) {
+	_, err := s.db.Exec(schemaSQL(s.db.isPostgres(), `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp
+		);`))
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = s.db.Get(&version, `SELECT COALESCE(MAX(version), 0) FROM schema_version`)
+	if err != nil {
+		return 0, err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if version > latest {
+		return version, fmt.Errorf("database schema version %d is newer than the latest this robokache knows, %d", version, latest)
+	}
+	return version, nil
+}
+
+// PendingMigrations lists the migrations that have not been applied yet
+func (s *Server) PendingMigrations() ([]Migration, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each in its own
+// transaction. It returns the migrations that were applied.
+func (s *Server) Migrate() ([]Migration, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range pending {
+		err = s.applyMigration(m)
+		if err != nil {
+			return pending[:i], fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+		log.WithFields(log.Fields{"version": m.Version}).Info("Applied migration: " + m.Description)
+	}
+	return pending, nil
+}
+
+// schemaLockID identifies the PostgreSQL advisory lock held while migrating
+const schemaLockID = 0x726f626f
+
+func (s *Server) applyMigration(m Migration) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if s.db.isPostgres() {
+		// Replicas starting at the same time take turns
+		_, err = tx.Exec(`SELECT pg_advisory_xact_lock(?)`, schemaLockID)
+		if err != nil {
+			return err
+		}
+	}
+	// Another replica may have applied it in the meantime
+	var applied int
+	err = tx.Get(&applied, `SELECT COUNT(*) FROM schema_version WHERE version=?`, m.Version)
+	if err != nil || applied > 0 {
+		return err
+	}
+
+	err = m.up(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO schema_version(version, description) VALUES (?, ?)`,
+		m.Version, m.Description)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetupDB brings the database up to date, applying migrations if
+// ROBOKACHE_AUTO_MIGRATE is set, and imports data stored by old versions
+func (s *Server) SetupDB() error {
+	if s.config.AutoMigrate {
+		_, err := s.Migrate()
+		if err != nil {
+			return err
+		}
+	} else {
+		pending, err := s.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("database schema needs %d migrations, run robokache migrate", len(pending))
+		}
+	}
+
+	err := s.importLegacyData()
+	if err != nil {
+		return fmt.Errorf("failed to import document data: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package robokache
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// useMemoryDB replaces the database with an empty one until the returned function is called
+func useMemoryDB(t *testing.T) func() {
+	saved := srv.db
+	srv.db = &database{sqlx.MustConnect("sqlite3", ":memory:")}
+	// Every connection would get its own in-memory database
+	srv.db.SetMaxOpenConns(1)
+	return func() {
+		srv.db.Close()
+		srv.db = saved
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	pending, err := srv.PendingMigrations()
+	assert.Nil(t, err)
+	assert.Len(t, pending, len(migrations))
+
+	applied, err := srv.Migrate()
+	assert.Nil(t, err)
+	assert.Len(t, applied, len(migrations))
+	version, err := srv.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, migrations[len(migrations)-1].Version, version)
+
+	// Nothing is left to do
+	pending, err = srv.PendingMigrations()
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+	applied, err = srv.Migrate()
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+
+	// A database from a newer version is not touched
+	_, err = srv.db.Exec(`INSERT INTO schema_version(version, description) VALUES (?, 'From the future')`,
+		version+1)
+	assert.Nil(t, err)
+	_, err = srv.Migrate()
+	assert.NotNil(t, err)
+}
+
+// Databases set up before schema_version existed are migrated without losing data
+func TestMigrateUnversioned(t *testing.T) {
+	defer useMemoryDB(t)()
+
+	// The document table as the first version of robokache made it
+	srv.db.MustExec(`
+		CREATE TABLE document (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			parent INTEGER,
+			owner TEXT,
+			visibility INTEGER,
+			metadata TEXT,
+			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp,
+			data_sha256 TEXT
+		);
+		CREATE TABLE blob (
+			sha256 TEXT PRIMARY KEY,
+			size INTEGER NOT NULL,
+			refs INTEGER NOT NULL
+		);
+		INSERT INTO blob(sha256, size, refs) VALUES ('abc', 42, 1);
+		INSERT INTO document(owner, visibility, data_sha256) VALUES ('me@robokache.com', 1, 'abc');`)
+
+	_, err := srv.Migrate()
+	assert.Nil(t, err)
+
+	var doc Document
+	err = srv.db.Get(&doc, `SELECT owner, data_size FROM document`)
+	assert.Nil(t, err)
+	assert.Equal(t, "me@robokache.com", doc.Owner)
+	// Sizes are filled in from the blob
+	if assert.NotNil(t, doc.DataSize) {
+		assert.Equal(t, int64(42), *doc.DataSize)
+	}
+}
+
+// Failed migrations are rolled back and not recorded
+func TestMigrateFailed(t *testing.T) {
+	defer useMemoryDB(t)()
+	defer func(saved []Migration) { migrations = saved }(migrations)
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		Migration{Version: 1000, Description: "Broken", up: execMigration(`
+			CREATE TABLE broken (id INTEGER);
+			INSERT INTO missing VALUES (1);`)})
+
+	applied, err := srv.Migrate()
+	assert.NotNil(t, err)
+	assert.Len(t, applied, len(migrations)-1)
+	version, err := srv.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, migrations[len(migrations)-2].Version, version)
+	var tables int
+	err = srv.db.Get(&tables, `SELECT COUNT(*) FROM sqlite_master WHERE name='broken'`)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, tables)
+}
+
+// Legacy data is imported until the import has finished once
+func TestImportLegacyData(t *testing.T) {
+	defer useMemoryDB(t)()
+	defer func(s BlobStore) { srv.store = s }(srv.store)
+	srv.store = newMemoryStore()
+
+	assert.Nil(t, srv.SetupDB())
+	srv.db.MustExec(`INSERT INTO document(id, owner, visibility, metadata) VALUES (1, 'me@robokache.com', 1, '{}')`)
+	putBlobForTest(t, legacyDataKey(1), "stored by an old version")
+
+	// A database that was already set up is not searched again
+	assert.Nil(t, srv.SetupDB())
+	_, err := srv.store.Stat(legacyDataKey(1))
+	assert.Nil(t, err)
+
+	srv.db.MustExec(`DELETE FROM setup_task`)
+	assert.Nil(t, srv.SetupDB())
+	_, err = srv.store.Stat(legacyDataKey(1))
+	assert.NotNil(t, err)
+	var digest *string
+	assert.Nil(t, srv.db.Get(&digest, `SELECT data_sha256 FROM document WHERE id=1`))
+	assert.NotNil(t, digest)
+	var finished int
+	assert.Nil(t, srv.db.Get(&finished, `SELECT COUNT(*) FROM setup_task`))
+	assert.Equal(t, 1, finished)
+}
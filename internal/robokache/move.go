@@ -0,0 +1,118 @@
+package robokache
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// treeLockID identifies the PostgreSQL advisory lock held while the parent
+// of a document changes, so that concurrent moves can't form a cycle
+const treeLockID = 0x74726565
+
+// MoveDocument makes parent the parent of a document, which takes its
+// subtree along. A nil parent makes the document a root. The move is recorded
+// as an edit by editor. It returns the IDs of the moved documents.
+func (s *Server) MoveDocument(editor string, id int, parent *int) ([]int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = lockTree(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing Document
+	err = tx.Get(&existing, `SELECT * FROM document WHERE id=? AND deleted_at IS NULL`, id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("not found: Check that the document exists")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if parent != nil {
+		err = checkNotBelow(tx, id, *parent)
+		if err != nil {
+			return nil, err
+		}
+		err = checkParent(tx, Document{Parent: parent, Owner: editor, Visibility: existing.Visibility},
+			"Check that the new parent exists, belongs to you and is not less visible than the document")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = checkSubtreeVisibility(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Documents in the trash move along too, to be restored where they were
+	moved, err := subtreeIDs(tx, id, true)
+	if err != nil {
+		return nil, err
+	}
+	doc := existing
+	doc.Parent = parent
+	_, err = tx.Exec(`UPDATE document SET parent=? WHERE id=?`, parent, id)
+	if err != nil {
+		return nil, err
+	}
+	err = addDocumentRevision(tx, editor, existing, doc)
+	if err != nil {
+		return nil, err
+	}
+	return moved, tx.Commit()
+}
+
+// lockTree keeps other transactions from changing parents until this one
+// ends. SQLite only has one writer at a time anyway.
+func lockTree(tx *transaction) error {
+	if !tx.isPostgres() {
+		return nil
+	}
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, treeLockID)
+	return err
+}
+
+// checkNotBelow fails if parent is the document itself or one of its
+// descendants, which would make a cycle
+func checkNotBelow(tx *transaction, id int, parent int) error {
+	// Documents in the trash count too, as they may be restored
+	below, err := subtreeIDs(tx, id, true)
+	if err != nil {
+		return err
+	}
+	for _, belowID := range below {
+		if belowID == parent {
+			return fmt.Errorf("bad request: A document can't be below itself or its descendants")
+		}
+	}
+	return nil
+}
+
+// checkSubtreeVisibility fails if a descendant of the document
+// is more visible than its parent
+func checkSubtreeVisibility(tx *transaction, id int) error {
+	var invalid int
+	err := tx.Get(&invalid, `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT id FROM document WHERE id=?
+			UNION
+			SELECT document.id FROM document JOIN subtree ON document.parent=subtree.id
+			WHERE document.deleted_at IS NULL
+		)
+		SELECT COUNT(*) FROM subtree
+		JOIN document AS child ON child.id=subtree.id
+		JOIN document AS parent ON parent.id=child.parent
+		WHERE child.id<>? AND child.visibility>parent.visibility
+	`, id, id)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 {
+		return fmt.Errorf("bad request: Check that no document below this one is more visible than its parent")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package robokache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func moveDocument(id string, parent string) (int, map[string][]string) {
+	requestBody := fmt.Sprintf(`{"parent": "%s"}`, parent)
+	w := performRequest(router, "POST", "/api/document/"+id+"/move", &signedString, &requestBody)
+	var response map[string][]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestMoveDocument(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	addTestDocument(9, 2, "me@robokache.com", shareable)
+	addTestDocument(10, 2, "me@robokache.com", shareable)
+	_, err := srv.DeleteDocument(Document{ID: 10}, false)
+	assert.Nil(t, err)
+
+	// The subtree moves along, with what is in the trash
+	code, response := moveDocument(hashOf(2), hashOf(3))
+	assert.Equal(t, http.StatusOK, code)
+	assert.ElementsMatch(t, []string{hashOf(2), hashOf(9), hashOf(10)}, response["moved"])
+	ancestors, err := srv.GetAncestors(nil, 9)
+	assert.Nil(t, err)
+	assert.Len(t, ancestors, 3)
+	assert.Equal(t, 1, ancestors[2].ID)
+
+	// The move is recorded
+	w := performRequest(router, "GET", "/api/document/"+hashOf(2)+"/revisions", &signedString, nil)
+	var revisions []DocumentRevision
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &revisions))
+	assert.Len(t, revisions, 1)
+	assert.Equal(t, hashOf(1), revisions[0].Old.ParentHash)
+	assert.Equal(t, hashOf(3), revisions[0].New.ParentHash)
+
+	// Not below itself
+	code, _ = moveDocument(hashOf(1), hashOf(9))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = moveDocument(hashOf(1), hashOf(1))
+	assert.Equal(t, http.StatusBadRequest, code)
+	// Not below a less visible or someone else's document
+	code, _ = moveDocument(hashOf(2), hashOf(0))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = moveDocument(hashOf(2), hashOf(4))
+	assert.Equal(t, http.StatusBadRequest, code)
+	// Not someone else's document
+	code, _ = moveDocument(hashOf(7), hashOf(1))
+	assert.Equal(t, http.StatusForbidden, code)
+	// The new parent has to be given
+	requestBody := `{}`
+	w = performRequest(router, "POST", "/api/document/"+hashOf(2)+"/move", &signedString, &requestBody)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// An empty parent makes it a root
+	code, _ = moveDocument(hashOf(2), "")
+	assert.Equal(t, http.StatusOK, code)
+	doc, err := srv.GetDocument(nil, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, doc.Parent)
+
+	// Every moved document has to be at most as visible as its parent
+	srv.db.MustExec(`UPDATE document SET visibility=3 WHERE id=9`)
+	code, _ = moveDocument(hashOf(2), hashOf(3))
+	assert.Equal(t, http.StatusBadRequest, code)
+	doc, err = srv.GetDocument(nil, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, doc.Parent)
+}
@@ -3,32 +3,78 @@ package robokache
 import (
 	"database/sql"
 	"fmt"
+	"io"
 )
 
 // PostDocument stores a document in the DB. It fails if question.owner != user.
-func PostDocument(doc Document) (int, error) {
-	if doc.Parent != nil {
-		// Check that the parent:
-		// 1. Exists
-		// 2. Has the same owner
-		// 3. Has more or the same visibility than the child
-		var parent Document
-		row := db.QueryRowx(
-			`SELECT * FROM document WHERE
-			 id=? AND owner=? AND visibility>=?
-			 `, doc.Parent, doc.Owner, doc.Visibility)
-		err := row.StructScan(&parent)
-		if err == sql.ErrNoRows {
-			return -1, fmt.Errorf("bad request: Check that the parent exists and does not have less visibility than the child you are trying to add")
-		} else if err != nil {
-			return -1, err
+func (s *Server) PostDocument(doc Document) (int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	newId, err := s.insertDocument(tx, doc)
+	if err != nil {
+		return -1, err
+	}
+	return newId, tx.Commit()
+}
+
+// PostDocumentWithData stores a document together with the data read from r.
+// The document is only created if its data is stored.
+func (s *Server) PostDocumentWithData(doc Document, r io.Reader, info DataInfo) (int, error) {
+	// Turn the document away before reading data for it
+	err := func() error {
+		tx, err := s.db.Beginx()
+		if err != nil {
+			return err
 		}
+		defer tx.Rollback()
+		return s.checkNewDocument(tx, doc)
+	}()
+	if err != nil {
+		return -1, err
+	}
+
+	return s.writeData(doc.Owner, -1, r, info, true, func(tx *transaction) (int, error) {
+		return s.insertDocument(tx, doc)
+	})
+}
+
+// checkNewDocument fails if the owner can't add doc
+func (s *Server) checkNewDocument(tx *transaction, doc Document) error {
+	err := s.checkDocumentQuota(tx, doc.Owner)
+	if err != nil {
+		return err
+	}
+	if doc.Parent != nil {
+		return checkParent(tx, doc,
+			"Check that the parent exists and does not have less visibility than the child you are trying to add")
+	}
+	return nil
+}
+
+// insertDocument adds a document in a transaction and returns its ID
+func (s *Server) insertDocument(tx *transaction, doc Document) (int, error) {
+	err := s.checkNewDocument(tx, doc)
+	if err != nil {
+		return -1, err
 	}
 	// Add question to DB
-	result, err := db.Exec(`
+	query := `
 		INSERT INTO document(owner, parent, visibility, metadata) VALUES
-    (?, ?, ?, ?);
-	`, doc.Owner, doc.Parent, doc.Visibility, doc.Metadata)
+    (?, ?, ?, ?)`
+	if tx.isPostgres() {
+		// PostgreSQL does not report the last insert ID
+		var newId int
+		err = tx.Get(&newId, query+" RETURNING id", doc.Owner, doc.Parent, doc.Visibility, doc.Metadata)
+		if err != nil {
+			return -1, err
+		}
+		return newId, nil
+	}
+	result, err := tx.Exec(query, doc.Owner, doc.Parent, doc.Visibility, doc.Metadata)
 
 	if err != nil {
 		return -1, err
@@ -39,3 +85,27 @@ func PostDocument(doc Document) (int, error) {
 	}
 	return int(newId), nil
 }
+
+// checkParent fails with a bad request unless the parent of doc:
+// 1. Exists
+// 2. Has the same owner
+// 3. Has more or the same visibility than the child
+// 4. Is not in the trash
+// With PostgreSQL the parent is locked until the transaction ends, so it
+// can't be changed by another request before doc is stored. SQLite
+// transactions take the write lock when they begin instead.
+func checkParent(tx *transaction, doc Document, message string) error {
+	query := `
+		SELECT id FROM document WHERE
+		id=? AND owner=? AND visibility>=? AND deleted_at IS NULL
+	`
+	if tx.isPostgres() {
+		query += " FOR SHARE"
+	}
+	var parent int
+	err := tx.Get(&parent, query, doc.Parent, doc.Owner, doc.Visibility)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("bad request: %s", message)
+	}
+	return err
+}
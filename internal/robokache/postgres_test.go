@@ -0,0 +1,100 @@
+package robokache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresTypes(t *testing.T) {
+	translated := postgresTypes.Replace(`
+		CREATE TABLE document_revision (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			document INTEGER NOT NULL,
+			created_at TIMESTAMP  NOT NULL  DEFAULT current_timestamp,
+			old_metadata TEXT,
+			wrapped_key BLOB
+		);`)
+	assert.Equal(t, `
+		CREATE TABLE document_revision (
+			id BIGSERIAL PRIMARY KEY,
+			document BIGINT NOT NULL,
+			created_at TIMESTAMPTZ  NOT NULL  DEFAULT current_timestamp,
+			old_metadata JSONB,
+			wrapped_key BYTEA
+		);`, translated)
+}
+
+// TestPostgres runs documents through the empty PostgreSQL database at
+// ROBOKACHE_TEST_POSTGRES_URL. The whole suite can also be run against
+// PostgreSQL by setting ROBOKACHE_DATABASE and ROBOKACHE_DATABASE_URL.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("ROBOKACHE_TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("ROBOKACHE_TEST_POSTGRES_URL is not set")
+	}
+	saved := srv.db
+	srv.db = &database{sqlx.MustConnect("postgres", url)}
+	defer func() {
+		srv.db.Close()
+		srv.db = saved
+	}()
+
+	_, err := srv.Migrate()
+	assert.Nil(t, err)
+	assert.Nil(t, srv.clearDB())
+	assert.Nil(t, srv.loadSampleData())
+
+	// Create a document with metadata under a sample document
+	parent, _ := srv.ids.idToHash(1)
+	requestBody := fmt.Sprintf(`{"parent": "%s", "metadata": {"name": "postgres"}}`, parent)
+	w := performRequest(router, "POST", "/api/document", &signedString, &requestBody)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Nil(t, err)
+	id := created["id"]
+
+	data := "Stored in PostgreSQL"
+	for _, version := range []string{"first", data} {
+		w = performRequest(router, "PUT",
+			fmt.Sprintf(`/api/document/%s/data`, id), &signedString, &version)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data`, id), &signedString, nil)
+	assert.Equal(t, data, w.Body.String())
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/data/revisions`, id), &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, strings.Count(w.Body.String(), `"data_sha256"`))
+
+	// Edit it and check the revision
+	requestBody = `{"metadata": {"name": "edited"}}`
+	w = performRequest(router, "PUT", "/api/document/"+id, &signedString, &requestBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET", "/api/document/"+id, &signedString, nil)
+	var doc Document
+	err = json.Unmarshal(w.Body.Bytes(), &doc)
+	assert.Nil(t, err)
+	assert.Equal(t, "edited", doc.Metadata["name"])
+	assert.Equal(t, parent, doc.ParentHash)
+	w = performRequest(router, "GET",
+		fmt.Sprintf(`/api/document/%s/revisions`, id), &signedString, nil)
+	assert.Contains(t, w.Body.String(), `"postgres"`)
+
+	w = performRequest(router, "GET", "/api/usage", &signedString, nil)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`"bytes":%d`, len(data)))
+
+	w = performRequest(router, "DELETE", "/api/document/"+id, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	report, err := srv.Fsck(FsckOptions{})
+	assert.Nil(t, err)
+	assert.False(t, report.Problems())
+}
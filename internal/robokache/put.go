@@ -4,12 +4,13 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
-	"os"
-	"strconv"
+	"mime"
+	"path"
+	"strings"
 )
 
 // EditDocument modifies the document with the given ID and updates the rest of the fields.
-func EditDocument(doc Document, existing Document) error {
+func (s *Server) EditDocument(doc Document, existing Document) error {
 
 	// Fill in parent and visibility fields if not given
 	if doc.Parent == nil {
@@ -19,57 +20,223 @@ func EditDocument(doc Document, existing Document) error {
 		doc.Visibility = existing.Visibility
 	}
 
+	return s.updateDocument(doc, existing)
+}
+
+// updateDocument sets the parent, visibility and metadata of a document and
+// records the change as a revision. doc.Owner is the user making the change.
+func (s *Server) updateDocument(doc Document, existing Document) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// If the parent is still null the document has no parent
 	if doc.Parent != nil {
-		var parent Document
-		// If a parent exists, we have to check that the parent fits these criteria:
-		// 1. Exists in the DB
-		// 2. Has the same owner
-		// 3. Has more or the same visibility than the child
-		row := db.QueryRowx(
-			`SELECT * FROM document WHERE
-			 id=? AND owner=? AND visibility>=?
-			 `, doc.Parent, doc.Owner, doc.Visibility)
-		err := row.StructScan(&parent)
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("bad request: Check that the parent exists and that you are not changing this document to be more visible than the parent")
-		} else if err != nil {
+		err = lockTree(tx)
+		if err != nil {
+			return err
+		}
+		err = checkParent(tx, doc,
+			"Check that the parent exists and that you are not changing this document to be more visible than the parent")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Record the edit against the document as it is now,
+	// in case it was edited since it was read
+	query := `SELECT * FROM document WHERE id=? AND deleted_at IS NULL`
+	if tx.isPostgres() {
+		query += " FOR UPDATE"
+	}
+	err = tx.Get(&existing, query, existing.ID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("not found: Check that the document exists")
+	} else if err != nil {
+		return err
+	}
+	if doc.Parent != nil && (existing.Parent == nil || *existing.Parent != *doc.Parent) {
+		err = checkNotBelow(tx, existing.ID, *doc.Parent)
+		if err != nil {
 			return err
 		}
 	}
 
 	// Update document
-	result, err := db.Exec(`
+	_, err = tx.Exec(`
 		UPDATE document SET
 		visibility=?, parent=?, metadata=?
 		WHERE id=?;
 	`, doc.Visibility, doc.Parent, doc.Metadata, doc.ID)
-
 	if err != nil {
 		return err
 	}
 
-	_, err = result.RowsAffected()
+	err = addDocumentRevision(tx, doc.Owner, existing, doc)
 	if err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
-func SetData(id int, r io.Reader) error {
-	filename := dataDir + "/files/" + strconv.Itoa(id)
+// DataInfo describes data as the client uploaded it
+type DataInfo struct {
+	// Media type of the data, empty if unknown
+	ContentType string `db:"content_type" json:"content_type"`
+	// Name of the file the data came from, empty if unknown
+	Filename string `db:"filename" json:"filename"`
+	// Hex SHA-256 digest the data must have, empty if it is not checked
+	SHA256 string `db:"sha256" json:"sha256"`
+}
 
-	// Open file for writing
-	file, err := os.Create(filename)
-	if err != nil {
+// NewDataInfo checks the content type and file name sent with data.
+// Directories are stripped from the file name.
+func NewDataInfo(contentType string, filename string) (DataInfo, error) {
+	var info DataInfo
+	if contentType != "" {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return info, fmt.Errorf("bad request: Invalid Content-Type: %v", err)
+		}
+		info.ContentType = mime.FormatMediaType(mediaType, params)
+	}
+	if filename != "" {
+		filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+		if filename == "." || filename == "/" || len(filename) > 255 {
+			return info, fmt.Errorf("bad request: Invalid filename")
+		}
+		info.Filename = filename
+	}
+	return info, nil
+}
+
+// Null instead of an empty string
+func nullIfEmpty(s string) *string {
+	if s == "" {
 		return nil
 	}
-	defer file.Close()
+	return &s
+}
 
-	// Use io.Copy to write without a buffer
-	_, err = io.Copy(file, r)
-	if err != nil {
+// SetData stores the data read from r as the data of the document with the given ID
+func (s *Server) SetData(id int, r io.Reader, info DataInfo) error {
+	return s.setData(id, r, info, true)
+}
+
+// setData stores data, only checking it against the size limit and
+// quota of the owner if enforceLimits is set
+func (s *Server) setData(id int, r io.Reader, info DataInfo, enforceLimits bool) error {
+	var owner string
+	err := s.db.Get(&owner, `SELECT owner FROM document WHERE id=? AND deleted_at IS NULL`, id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("not found: Check that the document exists")
+	} else if err != nil {
 		return err
 	}
-	return nil
+	_, err = s.writeData(owner, id, r, info, enforceLimits, func(tx *transaction) (int, error) {
+		// It may have been deleted while the data was read
+		query := `SELECT id FROM document WHERE id=? AND deleted_at IS NULL`
+		if tx.isPostgres() {
+			query += " FOR SHARE"
+		}
+		var live int
+		err := tx.Get(&live, query, id)
+		if err == sql.ErrNoRows {
+			return -1, fmt.Errorf("not found: Check that the document exists")
+		}
+		return id, err
+	})
+	return err
+}
+
+// writeData stores data of the owner as the data of the document that
+// target returns. It replaces the data of the document with the given ID,
+// or is the data of a new document if the ID is -1. target is called in the
+// transaction that points the document at the data, so a document it adds
+// is rolled back if the data can't be stored.
+func (s *Server) writeData(owner string, id int, r io.Reader, info DataInfo, enforceLimits bool, target func(tx *transaction) (int, error)) (int, error) {
+	if enforceLimits {
+		// Stop reading as soon as the data is too large or over the quota
+		if s.config.MaxDataSize > 0 {
+			r = &limitReader{r: r, n: s.config.MaxDataSize, err: s.dataSizeError()}
+		}
+		remaining, err := s.remainingBytes(s.db, owner, id)
+		if err != nil {
+			return -1, err
+		}
+		if remaining >= 0 {
+			r = &limitReader{r: r, n: remaining, err: s.byteQuotaError()}
+		}
+	}
+
+	staged, err := s.stageBlob(r)
+	if err != nil {
+		return -1, err
+	}
+	digest := staged.digest
+	if info.SHA256 != "" && info.SHA256 != digest {
+		s.store.Delete(staged.key)
+		return -1, fmt.Errorf("bad request: Data does not match the given digest, its SHA-256 is %s", digest)
+	}
+
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		s.store.Delete(staged.key)
+		return -1, err
+	}
+	defer unlock()
+
+	err = s.putBlob(staged)
+	if err != nil {
+		s.store.Delete(staged.key)
+		return -1, err
+	}
+
+	// Point the document at the new blob, keeping the old one as a revision
+	var released []string
+	err = func() error {
+		tx, err := s.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		id, err = target(tx)
+		if err != nil {
+			return err
+		}
+		if enforceLimits {
+			// Check again in case other data was stored in the meantime
+			remaining, err := s.remainingBytes(tx, owner, id)
+			if err != nil {
+				return err
+			}
+			if remaining >= 0 && staged.size > remaining {
+				return s.byteQuotaError()
+			}
+		}
+		err = retainBlob(tx, staged)
+		if err != nil {
+			return err
+		}
+		released, err = s.replaceData(tx, id, DataRevision{
+			DataSHA256:  digest,
+			DataSize:    &staged.size,
+			ContentType: nullIfEmpty(info.ContentType),
+			Filename:    nullIfEmpty(info.Filename),
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		// Don't leave the new blob behind if nothing refers to it
+		s.deleteBlobIfUnused(digest)
+		return -1, err
+	}
+
+	return id, s.deleteBlobsIfUnused(released)
 }
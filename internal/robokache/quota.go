@@ -0,0 +1,177 @@
+package robokache
+
+import (
+	"fmt"
+	"io"
+)
+
+// Each owner can have at most ROBOKACHE_QUOTA_DOCUMENTS documents holding at
+// most ROBOKACHE_QUOTA_BYTES of data. The earlier data kept as revisions
+// counts as well as the current data.
+
+// Usage is how much a user stores
+type Usage struct {
+	Documents int   `db:"documents" json:"documents"`
+	Bytes     int64 `db:"bytes"     json:"bytes"`
+	// Quotas, omitted if there is no limit
+	DocumentQuota int   `db:"-" json:"document_quota,omitempty"`
+	ByteQuota     int64 `db:"-" json:"byte_quota,omitempty"`
+}
+
+// GetUsage gets how much the owner stores and how much they may store
+func (s *Server) GetUsage(owner string) (Usage, error) {
+	usage, err := getUsage(s.db, owner)
+	usage.DocumentQuota = s.config.DocumentQuota
+	usage.ByteQuota = s.config.ByteQuota
+	return usage, err
+}
+
+func getUsage(q getter, owner string) (Usage, error) {
+	var usage Usage
+	err := q.Get(&usage, `
+		SELECT COUNT(*) AS documents, COALESCE(SUM(data_size), 0) AS bytes
+		FROM document WHERE owner=?
+	`, owner)
+	if err != nil {
+		return usage, err
+	}
+	revisions, err := revisionBytes(q, owner, -1)
+	usage.Bytes += revisions
+	return usage, err
+}
+
+// revisionBytes is the size of the revisions of the owner's documents,
+// leaving out those of the document with the given ID
+func revisionBytes(q getter, owner string, except int) (int64, error) {
+	var size int64
+	err := q.Get(&size, `
+		SELECT COALESCE(SUM(data_revision.data_size), 0) FROM data_revision
+		JOIN document ON document.id=data_revision.document
+		WHERE document.owner=? AND document.id<>?
+	`, owner, except)
+	return size, err
+}
+
+// checkDocumentQuota fails if the owner can't add another document
+func (s *Server) checkDocumentQuota(q getter, owner string) error {
+	if s.config.DocumentQuota <= 0 {
+		return nil
+	}
+	usage, err := getUsage(q, owner)
+	if err != nil {
+		return err
+	}
+	if usage.Documents >= s.config.DocumentQuota {
+		return fmt.Errorf("forbidden: You have reached your quota of %d documents", s.config.DocumentQuota)
+	}
+	return nil
+}
+
+// remainingBytes is how much data the owner can set as the data of the
+// document with the given ID, or of a new document if the ID is -1.
+// Replaced data counts as long as it is kept as a revision.
+// It is -1 if there is no limit.
+func (s *Server) remainingBytes(q getter, owner string, id int) (int64, error) {
+	if s.config.ByteQuota <= 0 {
+		return -1, nil
+	}
+	var used int64
+	err := q.Get(&used, `
+		SELECT COALESCE(SUM(data_size), 0) FROM document WHERE owner=? AND id<>?
+	`, owner, id)
+	if err != nil {
+		return 0, err
+	}
+	others, err := revisionBytes(q, owner, id)
+	if err != nil {
+		return 0, err
+	}
+	used += others
+	if id != -1 {
+		kept, err := s.keptRevisionBytes(q, id)
+		if err != nil {
+			return 0, err
+		}
+		used += kept
+	}
+	if used > s.config.ByteQuota {
+		return 0, nil
+	}
+	return s.config.ByteQuota - used, nil
+}
+
+// keptRevisionBytes is the size of the revisions a document keeps once its
+// data is replaced: its current data and the newest of its revisions,
+// up to ROBOKACHE_DATA_REVISIONS
+func (s *Server) keptRevisionBytes(q getter, id int) (int64, error) {
+	keep := s.config.DataRevisions
+	if keep <= 0 {
+		return 0, nil
+	}
+	var current struct {
+		DataSHA256 *string `db:"data_sha256"`
+		DataSize   *int64  `db:"data_size"`
+	}
+	err := q.Get(&current, `SELECT data_sha256, data_size FROM document WHERE id=?`, id)
+	if err != nil {
+		return 0, err
+	}
+	var kept int64
+	if current.DataSHA256 != nil {
+		if current.DataSize != nil {
+			kept = *current.DataSize
+		}
+		keep--
+	}
+	var revisions int64
+	err = q.Get(&revisions, `
+		SELECT COALESCE(SUM(data_size), 0) FROM (
+			SELECT data_size FROM data_revision WHERE document=? ORDER BY id DESC LIMIT ?
+		) AS kept
+	`, id, keep)
+	return kept + revisions, err
+}
+
+func (s *Server) byteQuotaError() error {
+	return fmt.Errorf("forbidden: This data would exceed your storage quota of %d bytes", s.config.ByteQuota)
+}
+
+// dataSizeError is returned for data over ROBOKACHE_MAX_DATA_SIZE
+func (s *Server) dataSizeError() error {
+	return fmt.Errorf("payload too large: Data must be at most %d bytes", s.config.MaxDataSize)
+}
+
+// documentSizeError is returned for JSON documents over ROBOKACHE_MAX_DOCUMENT_SIZE
+func (s *Server) documentSizeError() error {
+	return fmt.Errorf("payload too large: Documents must be at most %d bytes", s.config.MaxDocumentSize)
+}
+
+// limitReader fails with err once more than n bytes have been read,
+// so that data over a limit is rejected without reading all of it
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+// limitError is the error of a limitReader. It is told apart from
+// errors reading the request body so that it reaches the client as it is.
+type limitError struct {
+	error
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, limitError{l.err}
+	}
+	// Read one byte past the limit to notice data that is too long
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, limitError{l.err}
+	}
+	return n, err
+}
@@ -0,0 +1,251 @@
+package robokache
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Edits of the parent, visibility and metadata of a document are recorded as
+// document revisions with the values before and after.
+//
+// Setting the data of a document keeps the data it had before as a revision,
+// up to ROBOKACHE_DATA_REVISIONS per document. Each revision holds a reference
+// to its blob, so old data stays stored until its revision is pruned.
+
+// DataRevision is data that a document had before
+type DataRevision struct {
+	ID          int     `db:"id"           json:"id"`
+	Document    int     `db:"document"     json:"-"`
+	DataSHA256  string  `db:"data_sha256"  json:"data_sha256"`
+	DataSize    *int64  `db:"data_size"    json:"data_size"`
+	ContentType *string `db:"content_type" json:"content_type"`
+	Filename    *string `db:"filename"     json:"filename"`
+	// When the data was set
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// apply returns the document as it was with the revision's data
+func (r DataRevision) apply(doc Document) Document {
+	doc.DataSHA256 = &r.DataSHA256
+	doc.DataSize = r.DataSize
+	doc.ContentType = r.ContentType
+	doc.Filename = r.Filename
+	doc.DataUpdatedAt = &r.CreatedAt
+	return doc
+}
+
+// GetDataRevisions lists the earlier data of a document, newest first
+func (s *Server) GetDataRevisions(id int) ([]DataRevision, error) {
+	revisions := make([]DataRevision, 0)
+	err := s.db.Select(&revisions, `
+		SELECT * FROM data_revision WHERE document=? ORDER BY id DESC
+	`, id)
+	return revisions, err
+}
+
+// GetDataRevision gets one revision of the data of a document
+func (s *Server) GetDataRevision(id int, revision int) (DataRevision, error) {
+	var r DataRevision
+	err := s.db.Get(&r, `
+		SELECT * FROM data_revision WHERE id=? AND document=?
+	`, revision, id)
+	if err == sql.ErrNoRows {
+		return r, fmt.Errorf("not found: Check that the revision exists")
+	}
+	return r, err
+}
+
+// RestoreDataRevision makes a revision the current data of its document.
+// The data it replaces becomes a revision itself.
+func (s *Server) RestoreDataRevision(revision DataRevision) error {
+	unlock, err := s.lockBlobs()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner string
+	err = tx.Get(&owner, `SELECT owner FROM document WHERE id=?`, revision.Document)
+	if err != nil {
+		return err
+	}
+	remaining, err := s.remainingBytes(tx, owner, revision.Document)
+	if err != nil {
+		return err
+	}
+	if remaining >= 0 && revision.DataSize != nil && *revision.DataSize > remaining {
+		return s.byteQuotaError()
+	}
+
+	// The document gets a reference of its own to the revision's blob
+	_, err = tx.Exec(`UPDATE blob SET refs=refs+1 WHERE sha256=?`, revision.DataSHA256)
+	if err != nil {
+		return err
+	}
+	released, err := s.replaceData(tx, revision.Document, revision)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return s.deleteBlobsIfUnused(released)
+}
+
+// replaceData points a document at new data and keeps its old data as a
+// revision. The caller has to add the document's reference to the new blob.
+// It returns the digests of blobs released by pruning old revisions.
+func (s *Server) replaceData(tx *transaction, id int, data DataRevision) ([]string, error) {
+	var old Document
+	err := tx.Get(&old, `SELECT * FROM document WHERE id=?`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE document SET
+		data_sha256=?, data_size=?, data_updated_at=current_timestamp,
+		content_type=?, filename=?
+		WHERE id=?
+	`, data.DataSHA256, data.DataSize, data.ContentType, data.Filename, id)
+	if err != nil {
+		return nil, err
+	}
+	if old.DataSHA256 == nil {
+		return nil, nil
+	}
+
+	// The document's reference to its old blob moves to the revision
+	_, err = tx.Exec(`
+		INSERT INTO data_revision(document, data_sha256, data_size, content_type, filename, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, id, old.DataSHA256, old.DataSize, old.ContentType, old.Filename, old.dataModTime())
+	if err != nil {
+		return nil, err
+	}
+	return pruneDataRevisions(tx, id, s.config.DataRevisions)
+}
+
+// pruneDataRevisions removes all but the newest keep revisions of a document
+// and returns the digests of the blobs they released
+func pruneDataRevisions(tx *transaction, id int, keep int) ([]string, error) {
+	var revisions []DataRevision
+	err := tx.Select(&revisions, `
+		SELECT * FROM data_revision WHERE document=? ORDER BY id DESC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	released := make([]string, 0)
+	for i := keep; i < len(revisions); i++ {
+		_, err = tx.Exec(`DELETE FROM data_revision WHERE id=?`, revisions[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		err = releaseBlob(tx, revisions[i].DataSHA256)
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, revisions[i].DataSHA256)
+	}
+	return released, nil
+}
+
+// DocumentFields are the fields of a document that can be edited
+type DocumentFields struct {
+	Parent *int `db:"parent" json:"-"`
+	// Replaces parent in JSON
+	ParentHash string      `db:"-"          json:"parent"`
+	Visibility *visibility `db:"visibility" json:"visibility"`
+	Metadata   Metadata    `db:"metadata"   json:"metadata"`
+}
+
+func documentFields(doc Document) DocumentFields {
+	return DocumentFields{Parent: doc.Parent, Visibility: doc.Visibility, Metadata: doc.Metadata}
+}
+
+// DocumentRevision is an edit of a document
+type DocumentRevision struct {
+	ID       int `db:"id" json:"id"`
+	Document int `db:"document" json:"-"`
+	// User who made the edit
+	Editor    string         `db:"editor"     json:"editor"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	Old       DocumentFields `db:"old"        json:"old"`
+	New       DocumentFields `db:"new"        json:"new"`
+}
+
+// Change parent IDs in revision to hashes
+func (r *DocumentRevision) addHash(ids idCodec) error {
+	for _, fields := range []*DocumentFields{&r.Old, &r.New} {
+		if fields.Parent != nil {
+			var err error
+			fields.ParentHash, err = ids.idToHash(*fields.Parent)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const selectDocumentRevision = `
+	SELECT id, document, editor, created_at,
+	old_parent AS "old.parent", old_visibility AS "old.visibility", old_metadata AS "old.metadata",
+	new_parent AS "new.parent", new_visibility AS "new.visibility", new_metadata AS "new.metadata"
+	FROM document_revision
+`
+
+// addDocumentRevision records an edit of a document
+func addDocumentRevision(tx *transaction, editor string, old Document, new Document) error {
+	_, err := tx.Exec(`
+		INSERT INTO document_revision(document, editor,
+			old_parent, old_visibility, old_metadata,
+			new_parent, new_visibility, new_metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, old.ID, editor,
+		old.Parent, old.Visibility, old.Metadata,
+		new.Parent, new.Visibility, new.Metadata)
+	return err
+}
+
+// GetDocumentRevisions lists the edits of a document, newest first
+func (s *Server) GetDocumentRevisions(id int) ([]DocumentRevision, error) {
+	revisions := make([]DocumentRevision, 0)
+	err := s.db.Select(&revisions, selectDocumentRevision+`
+		WHERE document=? ORDER BY id DESC
+	`, id)
+	return revisions, err
+}
+
+// GetDocumentRevision gets one edit of a document
+func (s *Server) GetDocumentRevision(id int, revision int) (DocumentRevision, error) {
+	var r DocumentRevision
+	err := s.db.Get(&r, selectDocumentRevision+`
+		WHERE id=? AND document=?
+	`, revision, id)
+	if err == sql.ErrNoRows {
+		return r, fmt.Errorf("not found: Check that the revision exists")
+	}
+	return r, err
+}
+
+// RevertDocumentRevision undoes an edit by setting the fields of the document
+// back to what they were before it. The revert is recorded as an edit itself.
+func (s *Server) RevertDocumentRevision(editor string, existing Document, revision DocumentRevision) error {
+	doc := existing
+	doc.Owner = editor
+	doc.Parent = revision.Old.Parent
+	doc.Visibility = revision.Old.Visibility
+	doc.Metadata = revision.Old.Metadata
+	return s.updateDocument(doc, existing)
+}
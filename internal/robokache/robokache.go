@@ -0,0 +1,60 @@
+package robokache
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Server is a robokache instance. It owns its database, blob store,
+// document ID codec and HTTP client, so several can run in one process.
+type Server struct {
+	config     Config
+	db         *database
+	store      BlobStore
+	ids        idCodec
+	client     HTTPClient
+	masterKeys keyring
+
+	// blobMu serializes changes to reference counts and the blobs they count,
+	// so a blob cannot be deleted while another upload is starting to use it
+	blobMu sync.Mutex
+}
+
+// New opens the database and blob store of a Server.
+// SetupDB has to be called before it is used.
+func New(config Config) (*Server, error) {
+	s := &Server{config: config, client: config.HTTPClient}
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+
+	var err error
+	s.masterKeys, err = loadMasterKeys(config.MasterKey, config.OldMasterKeys)
+	if err != nil {
+		return nil, err
+	}
+	s.ids, err = newIDCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	s.store = config.Store
+	if s.store == nil {
+		s.store, err = openStore(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.db, err = connectDB(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *Server) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,129 @@
+package robokache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Servers in one process do not share documents or data
+func TestIsolatedServers(t *testing.T) {
+	var routers []http.Handler
+	for i := 0; i < 2; i++ {
+		s, err := New(testConfig(t.TempDir()))
+		assert.Nil(t, err)
+		defer s.Close()
+		assert.Nil(t, s.SetupDB())
+		routers = append(routers, s.SetupRouter())
+	}
+
+	requestBody := `{"visibility": 3, "metadata": {"name": "first"}}`
+	w := performRequest(routers[0], "POST", "/api/document", &signedString, &requestBody)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created map[string]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &created))
+	data := "Only in the first server"
+	w = performRequest(routers[0], "PUT", "/api/document/"+created["id"]+"/data", &signedString, &data)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(routers[0], "GET", "/api/document/"+created["id"]+"/data", &signedString, nil)
+	assert.Equal(t, data, w.Body.String())
+	w = performRequest(routers[1], "GET", "/api/document/"+created["id"], &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(routers[1], "GET", "/api/document", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+}
+
+// Transactions that read before they write wait for each other
+// instead of failing
+func TestConcurrentWrites(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	question, _ := srv.ids.idToHash(1)
+	answer, _ := srv.ids.idToHash(2)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 40)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				requestBody := fmt.Sprintf(`{"parent": "%s", "metadata": {"name": "edit %d"}}`, question, i)
+				codes[i] = performRequest(router, "PUT", "/api/document/"+answer, &signedString, &requestBody).Code
+			} else {
+				requestBody := fmt.Sprintf("Answer %d", i)
+				codes[i] = performRequest(router, "POST", "/api/document/"+question+"/children", &signedString, &requestBody).Code
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		assert.Equal(t, http.StatusOK, code, "request %d", i)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	// Limits above what fits in 32 bits
+	t.Setenv("ROBOKACHE_QUOTA_BYTES", "10000000000")
+	t.Setenv("ROBOKACHE_TRASH_RETENTION", "48h")
+	config, err := ConfigFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10000000000), config.ByteQuota)
+	assert.Equal(t, 48*time.Hour, config.TrashRetention)
+	assert.Equal(t, DefaultConfig().DataRevisions, config.DataRevisions)
+
+	// Malformed values are errors, not panics
+	t.Setenv("ROBOKACHE_MAX_DATA_SIZE", "1GB")
+	_, err = ConfigFromEnv()
+	assert.EqualError(t, err, `ROBOKACHE_MAX_DATA_SIZE must be a number: strconv.ParseInt: parsing "1GB": invalid syntax`)
+	t.Setenv("ROBOKACHE_MAX_DATA_SIZE", "")
+	t.Setenv("ROBOKACHE_UPLOAD_EXPIRY", "a day")
+	_, err = ConfigFromEnv()
+	assert.NotNil(t, err)
+}
+
+// Only one of several requests finishing an upload adds the document
+func TestConcurrentUploadFinish(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	uploadID, err := srv.CreateUpload("me@robokache.com", 1, uploadChild, 5, DataInfo{})
+	assert.Nil(t, err)
+	upload, err := srv.GetUpload("me@robokache.com", uploadID)
+	assert.Nil(t, err)
+	_, err = srv.WriteUpload(upload, 0, strings.NewReader("01234"))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			empty := ""
+			codes[i] = performRequestWithHeaders(router, "PATCH", "/api/uploads/"+uploadID, &signedString, &empty,
+				map[string]string{"Upload-Offset": "5"}).Code
+		}(i)
+	}
+	wg.Wait()
+	finished := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			finished++
+		} else {
+			// Still being finished, or already gone
+			assert.Contains(t, []int{http.StatusConflict, http.StatusNotFound}, code)
+		}
+	}
+	assert.Equal(t, 1, finished)
+	var children int
+	assert.Nil(t, srv.db.Get(&children, `SELECT COUNT(*) FROM document WHERE parent=1`))
+	assert.Equal(t, 3, children)
+}
@@ -0,0 +1,190 @@
+package robokache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Size of the parts that uploads are split into.
+// This is how much of an upload is held in memory at once.
+const s3PartSize = 16 * 1024 * 1024
+
+// s3Store keeps blobs as objects in an S3-compatible bucket
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// S3Config says how to reach an S3-compatible bucket
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Secure    bool
+	// Transport overrides the HTTP transport used to reach the endpoint
+	Transport http.RoundTripper
+}
+
+func newS3Store(config S3Config) (*s3Store, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:     credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:    config.Secure,
+		Region:    config.Region,
+		Transport: config.Transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail early if the bucket is not there
+	exists, err := client.BucketExists(context.Background(), config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket \"%s\" does not exist", config.Bucket)
+	}
+
+	return &s3Store{client: client, bucket: config.Bucket, prefix: config.Prefix}, nil
+}
+
+func (s *s3Store) object(key string) string {
+	return s.prefix + key
+}
+
+// Translate missing object errors into the errors BlobStore promises
+func s3Err(op string, key string, err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (s *s3Store) Open(key string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(context.Background(),
+		s.bucket, s.object(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Err("open", key, err)
+	}
+	// GetObject is lazy; Stat makes the request so a missing object
+	// is reported here instead of on the first read
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s3Err("open", key, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Store) Create(key string) (BlobWriter, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+
+	// The upload reads from the pipe as the caller writes to it,
+	// so only one part is buffered at a time
+	go func() {
+		_, err := s.client.PutObject(context.Background(),
+			s.bucket, s.object(key), pr, -1,
+			minio.PutObjectOptions{PartSize: s3PartSize})
+		// Unblock the writer if the upload failed early.
+		// A failed upload is aborted, so nothing is stored.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	// Removing a missing object is not an error in S3, so check first
+	_, err := s.Stat(key)
+	if err != nil {
+		return err
+	}
+	err = s.client.RemoveObject(context.Background(),
+		s.bucket, s.object(key), minio.RemoveObjectOptions{})
+	if err != nil {
+		return s3Err("remove", key, err)
+	}
+	return nil
+}
+
+// Rename copies the object and removes the original since S3 cannot move
+// objects. A single copy is limited to 5 GiB.
+func (s *s3Store) Rename(oldKey string, newKey string) error {
+	_, err := s.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.object(newKey)},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.object(oldKey)})
+	if err != nil {
+		return s3Err("rename", oldKey, err)
+	}
+	err = s.client.RemoveObject(context.Background(),
+		s.bucket, s.object(oldKey), minio.RemoveObjectOptions{})
+	if err != nil {
+		return s3Err("rename", oldKey, err)
+	}
+	return nil
+}
+
+func (s *s3Store) Stat(key string) (BlobInfo, error) {
+	info, err := s.client.StatObject(context.Background(),
+		s.bucket, s.object(key), minio.StatObjectOptions{})
+	if err != nil {
+		return BlobInfo{}, s3Err("stat", key, err)
+	}
+	return BlobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Store) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	objects := s.client.ListObjects(context.Background(), s.bucket,
+		minio.ListObjectsOptions{Prefix: s.object(prefix), Recursive: true})
+	for obj := range objects {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, strings.TrimPrefix(obj.Key, s.prefix))
+	}
+	return keys, nil
+}
+
+// s3Writer feeds an upload running in the background
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Commit finishes the upload and waits for it to complete.
+// The object only appears once the multipart upload is completed.
+func (w *s3Writer) Commit() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// Abort makes the upload fail so that its parts are discarded
+func (w *s3Writer) Abort() error {
+	w.pw.CloseWithError(errUploadAborted)
+	err := <-w.done
+	if err != nil && err != errUploadAborted {
+		return err
+	}
+	return nil
+}
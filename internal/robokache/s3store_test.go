@@ -0,0 +1,218 @@
+package robokache
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 implements the parts of the S3 API that s3Store uses
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]memoryBlob
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string]memoryBlob),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		type object struct {
+			Key          string
+			LastModified time.Time
+			Size         int
+			ETag         string
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			IsTruncated bool
+			Contents    []object
+		}{Name: bucket, Prefix: query.Get("prefix")}
+		for objectKey, obj := range f.objects {
+			if strings.HasPrefix(objectKey, result.Prefix) {
+				result.Contents = append(result.Contents,
+					object{Key: objectKey, LastModified: obj.modTime, Size: len(obj.data), ETag: `"etag"`})
+			}
+		}
+		result.KeyCount = len(result.Contents)
+		f.xml(w, result)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		uploadID := strconv.Itoa(f.nextID)
+		f.uploads[uploadID] = make(map[int][]byte)
+		f.xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: uploadID})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := io.ReadAll(r.Body)
+		parts[partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var data bytes.Buffer
+		for _, n := range numbers {
+			data.Write(parts[n])
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.objects[key] = memoryBlob{data: data.Bytes(), modTime: time.Now()}
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"complete"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), f.bucket+"/")
+		obj, ok := f.objects[source]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		f.objects[key] = memoryBlob{data: obj.data, modTime: time.Now()}
+		f.xml(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			LastModified time.Time
+			ETag         string
+		}{LastModified: time.Now(), ETag: `"etag"`})
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func newTestS3Store(t *testing.T) *s3Store {
+	server := httptest.NewServer(newFakeS3("robokache"))
+	t.Cleanup(server.Close)
+
+	s, err := newS3Store(S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "robokache",
+		Prefix:    "test/",
+		AccessKey: "access",
+		SecretKey: "secret",
+		Region:    "us-east-1",
+	})
+	assert.Nil(t, err)
+	return s
+}
+
+func TestS3Store(t *testing.T) {
+	testBlobStore(t, newTestS3Store(t))
+}
+
+func TestS3StoreMissingBucket(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("robokache"))
+	defer server.Close()
+
+	_, err := newS3Store(S3Config{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Bucket:   "missing",
+		Region:   "us-east-1",
+	})
+	assert.NotNil(t, err)
+}
+
+// Uploads larger than one part are split up rather than held in memory
+func TestS3StoreMultipartUpload(t *testing.T) {
+	s := newTestS3Store(t)
+
+	data := bytes.Repeat([]byte("robokache"), s3PartSize/4)
+	w, err := s.Create("large")
+	assert.Nil(t, err)
+	_, err = io.Copy(w, bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Commit())
+
+	r, err := s.Open("large")
+	assert.Nil(t, err)
+	defer r.Close()
+	stored, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, stored)
+}
@@ -1,23 +1,19 @@
 package robokache
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
-// Initialize logging
-func init() {
-	if gin.Mode() == gin.DebugMode {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.WarnLevel)
-	}
-}
-
 func handleErr(c *gin.Context, err error) {
 	errorMsg := err.Error()
 	errorResponse := map[string]string{
@@ -31,6 +27,10 @@ func handleErr(c *gin.Context, err error) {
 		c.JSON(403, errorResponse)
 	} else if strings.HasPrefix(errorMsg, "not found") {
 		c.JSON(404, errorResponse)
+	} else if strings.HasPrefix(errorMsg, "conflict") {
+		c.JSON(409, errorResponse)
+	} else if strings.HasPrefix(errorMsg, "payload too large") {
+		c.JSON(413, errorResponse)
 	} else {
 		log.WithFields(log.Fields{"error": err}).
 			WithContext(c).
@@ -66,6 +66,142 @@ type GetDocumentQuery struct {
 	HasParent *bool `form:"has_parent"`
 }
 
+// Query parameters for Document tree request
+type GetTreeQuery struct {
+	Depth *int `form:"depth"`
+}
+
+// Body of a move request
+type MoveRequest struct {
+	// Hash of the new parent, empty to make the document a root
+	Parent *string `json:"parent" binding:"required"`
+}
+
+// Query parameters for Document delete request
+type DeleteDocumentQuery struct {
+	Recursive bool `form:"recursive"`
+}
+
+// Parse a header that holds a number of bytes
+func getSizeHeader(c *gin.Context, name string) (int64, error) {
+	size, err := strconv.ParseInt(c.GetHeader(name), 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("bad request: Missing or invalid %s header", name)
+	}
+	return size, nil
+}
+
+// getRevisionParam parses the revision number in the URL
+func getRevisionParam(c *gin.Context) (int, error) {
+	revision, err := strconv.Atoi(c.Param("revision"))
+	if err != nil {
+		return -1, fmt.Errorf("not found: Check that the revision exists")
+	}
+	return revision, nil
+}
+
+// requestData returns the request body, decompressing it if it was sent compressed
+func (s *Server) requestData(c *gin.Context) (io.Reader, error) {
+	switch c.GetHeader("Content-Encoding") {
+	case "", "identity":
+		// Don't wait for the body to turn away data that is too large
+		if s.config.MaxDataSize > 0 && c.Request.ContentLength > s.config.MaxDataSize {
+			return nil, s.dataSizeError()
+		}
+		return c.Request.Body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			return nil, fmt.Errorf("bad request: Body is not valid gzip: %v", err)
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("bad request: Content-Encoding must be gzip or identity")
+	}
+}
+
+// bindDocument parses the JSON document in the request body,
+// which must not be larger than ROBOKACHE_MAX_DOCUMENT_SIZE
+func (s *Server) bindDocument(c *gin.Context, doc interface{}) error {
+	if s.config.MaxDocumentSize > 0 {
+		if c.Request.ContentLength > s.config.MaxDocumentSize {
+			return s.documentSizeError()
+		}
+		c.Request.Body = io.NopCloser(&limitReader{
+			r: c.Request.Body, n: s.config.MaxDocumentSize, err: s.documentSizeError(),
+		})
+	}
+	err := c.ShouldBindJSON(doc)
+	var limit limitError
+	if errors.As(err, &limit) {
+		return limit.error
+	} else if err != nil {
+		return fmt.Errorf("bad request: Invalid JSON document: %v", err)
+	}
+	return nil
+}
+
+// requestDataInfo reads the content type of uploaded data from the given
+// header, its file name from the filename query parameter and the digest
+// it must have from the Repr-Digest or Digest header
+func requestDataInfo(c *gin.Context, contentTypeHeader string) (DataInfo, error) {
+	info, err := NewDataInfo(c.GetHeader(contentTypeHeader), c.Query("filename"))
+	if err != nil {
+		return info, err
+	}
+	digestHeader := c.GetHeader("Repr-Digest")
+	if digestHeader == "" {
+		digestHeader = c.GetHeader("Digest")
+	}
+	info.SHA256, err = parseSHA256Digest(digestHeader)
+	return info, err
+}
+
+// serveData writes the data of a document to the response
+func (s *Server) serveData(c *gin.Context, document Document) {
+	// Get data from storage
+	data, err := s.OpenData(document, c.GetHeader("Accept-Encoding"))
+	if err != nil {
+		handleErr(c, err)
+		return
+	}
+	defer data.Close()
+
+	contentType := "application/octet-stream"
+	if document.ContentType != nil {
+		contentType = *document.ContentType
+	}
+	c.Header("Content-Type", contentType)
+	if document.Filename != nil {
+		c.Header("Content-Disposition", mime.FormatMediaType(
+			"inline", map[string]string{"filename": *document.Filename}))
+	}
+	// Uploaded content is rendered without access to this site
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("Vary", "Accept-Encoding")
+	if data.Encoding != "" {
+		c.Header("Content-Encoding", data.Encoding)
+	} else if document.DataSHA256 != nil {
+		// The digest is of the data before it is encoded
+		reprDigest, legacyDigest := formatSHA256Digest(*document.DataSHA256)
+		c.Header("Repr-Digest", reprDigest)
+		c.Header("Digest", legacyDigest)
+	}
+	if etag := document.dataETag(data.Encoding); etag != "" {
+		c.Header("ETag", etag)
+	}
+	// Caches have to check that their copy is still current
+	if *document.Visibility >= public {
+		c.Header("Cache-Control", "public, no-cache")
+	} else {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+	// ServeContent handles Range requests and conditional
+	// requests and writes the data to the HTTP response
+	http.ServeContent(c.Writer, c.Request, "", document.dataModTime(), data)
+}
+
 func GetUserEmail(c *gin.Context) *string {
 	val, ok := c.Get("userEmail")
 	if ok {
@@ -76,11 +212,11 @@ func GetUserEmail(c *gin.Context) *string {
 }
 
 // SetupRouter sets up the router
-func SetupRouter() *gin.Engine {
+func (s *Server) SetupRouter() *gin.Engine {
 	r := gin.Default()
 
 	// validateUser also adds userEmail to Context
-	r.Use(validateUser)
+	r.Use(s.validateUser)
 
 	api := r.Group("/api")
 
@@ -99,7 +235,7 @@ func SetupRouter() *gin.Engine {
 			}
 
 			// Get documents from database
-			documents, err := GetDocuments(userEmail, queryParams.HasParent)
+			documents, err := s.GetDocuments(userEmail, queryParams.HasParent)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -107,7 +243,7 @@ func SetupRouter() *gin.Engine {
 
 			// Relace the ID with a hashed ID for each document
 			for i := range documents {
-				documents[i].addHash()
+				documents[i].addHash(s.ids)
 				// If userEmail == nil, none of the documents will have the
 				// "owned" flag set to true
 				if userEmail != nil {
@@ -122,20 +258,20 @@ func SetupRouter() *gin.Engine {
 			userEmail := GetUserEmail(c)
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Get document from database
-			document, err := GetDocument(userEmail, id)
+			document, err := s.GetDocument(userEmail, id)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
-			document.addHash()
+			document.addHash(s.ids)
 			if userEmail != nil {
 				document.addOwned(*userEmail)
 			}
@@ -143,11 +279,114 @@ func SetupRouter() *gin.Engine {
 			// Return
 			c.JSON(http.StatusOK, document)
 		})
+		api.GET("/document/:id/tree", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			var queryParams GetTreeQuery
+			err = c.ShouldBindQuery(&queryParams)
+			if err != nil || (queryParams.Depth != nil && *queryParams.Depth < 0) {
+				handleErr(c, fmt.Errorf("bad request: Error parsing query parameters"))
+				return
+			}
+			depth := maxTreeDepth
+			if queryParams.Depth != nil {
+				depth = *queryParams.Depth
+			}
+
+			tree, err := s.GetDocumentTree(userEmail, id, depth)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			err = tree.addHash(s.ids, userEmail)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, tree)
+		})
+		api.GET("/document/:id/ancestors", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			ancestors, err := s.GetAncestors(userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Convert IDs to hashes
+			for i := range ancestors {
+				ancestors[i].addHash(s.ids)
+				if userEmail != nil {
+					ancestors[i].addOwned(*userEmail)
+				}
+			}
+			c.JSON(http.StatusOK, ancestors)
+		})
 		api.GET("/document/:id/data", func(c *gin.Context) {
 			userEmail := GetUserEmail(c)
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Get document from database to ensure we have permission
+			// to access this endpoint
+			document, err := s.GetDocument(userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			s.serveData(c, document)
+		})
+		api.GET("/document/:id/data/revisions", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Get document from database to ensure we have permission
+			// to access this endpoint
+			_, err = s.GetDocument(userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			revisions, err := s.GetDataRevisions(id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, revisions)
+		})
+		api.GET("/document/:id/data/revisions/:revision", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -155,25 +394,45 @@ func SetupRouter() *gin.Engine {
 
 			// Get document from database to ensure we have permission
 			// to access this endpoint
-			_, err = GetDocument(userEmail, id)
+			document, err := s.GetDocument(userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			revisionNumber, err := getRevisionParam(c)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
+			revision, err := s.GetDataRevision(id, revisionNumber)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			s.serveData(c, revision.apply(document))
+		})
+		api.GET("/usage", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to see your usage"))
+				return
+			}
 
-			c.Header("Content-Type", "application/octet-stream")
-			// Get data from disk and write it to HTTP response
-			err = GetData(id, c.Writer)
+			usage, err := s.GetUsage(*userEmail)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
+			c.JSON(http.StatusOK, usage)
 		})
 		api.GET("/document/:id/children", func(c *gin.Context) {
 			userEmail := GetUserEmail(c)
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -181,14 +440,14 @@ func SetupRouter() *gin.Engine {
 
 			// Get document from database to ensure we have permission
 			// to access this endpoint
-			_, err = GetDocument(userEmail, id)
+			_, err = s.GetDocument(userEmail, id)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Get documents that have this as a parent
-			documents, err := GetDocumentChildren(userEmail, id)
+			documents, err := s.GetDocumentChildren(userEmail, id)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -196,7 +455,7 @@ func SetupRouter() *gin.Engine {
 
 			// Convert IDs to hashes
 			for i := range documents {
-				documents[i].addHash()
+				documents[i].addHash(s.ids)
 				if userEmail != nil {
 					documents[i].addOwned(*userEmail)
 				}
@@ -216,7 +475,7 @@ func SetupRouter() *gin.Engine {
 			}
 
 			// Get document id
-			parentID, err := hashToID(c.Param("id"))
+			parentID, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -224,33 +483,38 @@ func SetupRouter() *gin.Engine {
 
 			// Get the parent so we can set the default visibility
 			// to the visibility of the parent
-			parent, err := GetDocument(userEmail, parentID)
+			parent, err := s.GetDocument(userEmail, parentID)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
-			newDoc := Document{
-				Parent:     &parent.ID,
-				Visibility: parent.Visibility,
-				Owner:      *userEmail,
-			}
 
-			// Add the document to the database
-			newDocID, err := PostDocument(newDoc)
+			data, err := s.requestData(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			info, err := requestDataInfo(c, "Content-Type")
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
-			// Write data to disk
-			err = SetData(newDocID, c.Request.Body)
+			newDoc := Document{
+				Parent:     &parent.ID,
+				Visibility: parent.Visibility,
+				Owner:      *userEmail,
+			}
+
+			// Add the document to the database with its data
+			newDocID, err := s.PostDocumentWithData(newDoc, data, info)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Convert ID to hash
-			newDocIDHash, err := idToHash(newDocID)
+			newDocIDHash, err := s.ids.idToHash(newDocID)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -271,7 +535,7 @@ func SetupRouter() *gin.Engine {
 
 			// Parse the document from JSON
 			doc := makeDefaultDoc()
-			err := c.ShouldBindJSON(&doc)
+			err := s.bindDocument(c, &doc)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -280,21 +544,21 @@ func SetupRouter() *gin.Engine {
 			doc.Owner = *userEmail
 
 			// Convert user given hashes to IDs
-			err = doc.addID()
+			err = doc.addID(s.ids)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Add document to DB
-			newID, err := PostDocument(doc)
+			newID, err := s.PostDocument(doc)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Convert new ID to hash
-			hashedID, err := idToHash(newID)
+			hashedID, err := s.ids.idToHash(newID)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -316,7 +580,7 @@ func SetupRouter() *gin.Engine {
 			}
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -324,20 +588,20 @@ func SetupRouter() *gin.Engine {
 
 			// Parse the document from JSON
 			var doc Document
-			err = c.ShouldBindJSON(&doc)
+			err = s.bindDocument(c, &doc)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 			// Convert user-given parent hash and ID hash to IDs
-			err = doc.addID()
+			err = doc.addID(s.ids)
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Check we have permission to update this document
-			existingDoc, err := GetDocumentForEditing(*userEmail, id)
+			existingDoc, err := s.GetDocumentForEditing(*userEmail, id)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -349,7 +613,7 @@ func SetupRouter() *gin.Engine {
 			doc.ID = id
 
 			// Add document to DB
-			err = EditDocument(doc, existingDoc)
+			err = s.EditDocument(doc, existingDoc)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -361,6 +625,178 @@ func SetupRouter() *gin.Engine {
 			response := make(map[string]string)
 			c.JSON(http.StatusOK, response)
 		})
+		api.POST("/document/:id/move", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to move a document"))
+				return
+			}
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			var request MoveRequest
+			err = s.bindDocument(c, &request)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			var parent *int
+			if *request.Parent != "" {
+				parentID, err := s.ids.hashToID(*request.Parent)
+				if err != nil {
+					handleErr(c, err)
+					return
+				}
+				parent = &parentID
+			}
+
+			// Check we have permission to move this document
+			_, err = s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			moved, err := s.MoveDocument(*userEmail, id, parent)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			hashes, err := s.ids.idsToHashes(moved)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"moved": hashes})
+		})
+		api.GET("/document/:id/revisions", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to see the revisions of a document"))
+				return
+			}
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Only the owner can see who edited the document
+			_, err = s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			revisions, err := s.GetDocumentRevisions(id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Convert IDs to hashes
+			for i := range revisions {
+				err = revisions[i].addHash(s.ids)
+				if err != nil {
+					handleErr(c, err)
+					return
+				}
+			}
+			c.JSON(http.StatusOK, revisions)
+		})
+		api.POST("/document/:id/revisions/:revision/revert", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to edit a document"))
+				return
+			}
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Check we have permission to update this document
+			existingDoc, err := s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			revisionNumber, err := getRevisionParam(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			revision, err := s.GetDocumentRevision(id, revisionNumber)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			err = s.RevertDocumentRevision(*userEmail, existingDoc, revision)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			response := make(map[string]string)
+			c.JSON(http.StatusOK, response)
+		})
+		api.POST("/document/:id/data/revisions/:revision/restore", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to edit a document"))
+				return
+			}
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Check we have permission to update this document
+			_, err = s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			revisionNumber, err := getRevisionParam(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			revision, err := s.GetDataRevision(id, revisionNumber)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			err = s.RestoreDataRevision(revision)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			response := make(map[string]string)
+			c.JSON(http.StatusOK, response)
+		})
 		api.PUT("/document/:id/data", func(c *gin.Context) {
 			userEmail := GetUserEmail(c)
 			if userEmail == nil {
@@ -370,21 +806,32 @@ func SetupRouter() *gin.Engine {
 			}
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Check we have permission to update this document
-			_, err = GetDocumentForEditing(*userEmail, id)
+			_, err = s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			data, err := s.requestData(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			info, err := requestDataInfo(c, "Content-Type")
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
-			// Write data to disk
-			err = SetData(id, c.Request.Body)
+			// Write data to storage
+			err = s.SetData(id, data, info)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -404,20 +851,263 @@ func SetupRouter() *gin.Engine {
 			}
 
 			// Get document id
-			id, err := hashToID(c.Param("id"))
+			id, err := s.ids.hashToID(c.Param("id"))
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
 			// Check we have permission to delete this document
-			existingDoc, err := GetDocumentForEditing(*userEmail, id)
+			existingDoc, err := s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			var queryParams DeleteDocumentQuery
+			err = c.ShouldBindQuery(&queryParams)
+			if err != nil {
+				handleErr(c, fmt.Errorf("bad request: Error parsing query parameters"))
+				return
+			}
+
+			deleted, err := s.DeleteDocument(existingDoc, queryParams.Recursive)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Report the deleted documents by hash
+			hashes, err := s.ids.idsToHashes(deleted)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"deleted": hashes})
+		})
+	}
+	// Trash
+	{
+		api.GET("/trash", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to see your trash"))
+				return
+			}
+
+			documents, err := s.GetTrash(*userEmail)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			for i := range documents {
+				documents[i].addHash(s.ids)
+				documents[i].addOwned(*userEmail)
+			}
+			c.JSON(http.StatusOK, documents)
+		})
+
+		// getTrashedDocument gets the document in the trash that the URL names
+		getTrashedDocument := func(c *gin.Context) (Document, error) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				return Document{}, fmt.Errorf("unauthorized: You must be logged in to change your trash")
+			}
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				return Document{}, err
+			}
+			return s.GetTrashedDocument(*userEmail, id)
+		}
+
+		api.POST("/trash/:id/restore", func(c *gin.Context) {
+			document, err := getTrashedDocument(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			restored, err := s.RestoreDocument(document)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			hashes, err := s.ids.idsToHashes(restored)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"restored": hashes})
+		})
+		api.DELETE("/trash/:id", func(c *gin.Context) {
+			document, err := getTrashedDocument(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			purged, err := s.PurgeDocument(document)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			hashes, err := s.ids.idsToHashes(purged)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"deleted": hashes})
+		})
+	}
+	// Resumable uploads
+	{
+		// startUpload creates an upload for a document the user can edit
+		startUpload := func(c *gin.Context, kind string) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to upload data"))
+				return
+			}
+
+			// Get document id
+			id, err := s.ids.hashToID(c.Param("id"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Check we have permission to update this document
+			_, err = s.GetDocumentForEditing(*userEmail, id)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			length, err := getSizeHeader(c, "Upload-Length")
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// The body of this request is empty, so the
+			// content type of the data has its own header
+			info, err := requestDataInfo(c, "Upload-Content-Type")
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			uploadID, err := s.CreateUpload(*userEmail, id, kind, length, info)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			c.Header("Location", "/api/uploads/"+uploadID)
+			c.Header("Upload-Offset", "0")
+			response := make(map[string]string)
+			response["id"] = uploadID
+			c.JSON(http.StatusCreated, response)
+		}
+		api.POST("/document/:id/data/uploads", func(c *gin.Context) {
+			startUpload(c, uploadData)
+		})
+		api.POST("/document/:id/children/uploads", func(c *gin.Context) {
+			startUpload(c, uploadChild)
+		})
+
+		getUpload := func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to upload data"))
+				return
+			}
+
+			upload, err := s.GetUpload(*userEmail, c.Param("upload"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Tell the client where to resume
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+			c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+			c.JSON(http.StatusOK, upload)
+		}
+		api.HEAD("/uploads/:upload", getUpload)
+		api.GET("/uploads/:upload", getUpload)
+
+		api.PATCH("/uploads/:upload", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to upload data"))
+				return
+			}
+
+			upload, err := s.GetUpload(*userEmail, c.Param("upload"))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			offset, err := getSizeHeader(c, "Upload-Offset")
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Offsets count decompressed bytes
+			data, err := s.requestData(c)
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			// Append the body to the upload
+			upload, err = s.WriteUpload(upload, offset, data)
+			c.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+			if err != nil {
+				handleErr(c, err)
+				return
+			}
+
+			response := make(map[string]interface{})
+			response["offset"] = upload.Received
+			if upload.Received == upload.Length {
+				// All data is here, so store it with its document
+				docID, err := s.FinishUpload(upload)
+				if err != nil {
+					handleErr(c, err)
+					return
+				}
+				response["id"], err = s.ids.idToHash(docID)
+				if err != nil {
+					handleErr(c, err)
+					return
+				}
+			}
+			c.JSON(http.StatusOK, response)
+		})
+
+		api.DELETE("/uploads/:upload", func(c *gin.Context) {
+			userEmail := GetUserEmail(c)
+			if userEmail == nil {
+				handleErr(c,
+					fmt.Errorf("unauthorized: You must be logged in to upload data"))
+				return
+			}
+
+			upload, err := s.GetUpload(*userEmail, c.Param("upload"))
 			if err != nil {
 				handleErr(c, err)
 				return
 			}
 
-			err = DeleteDocument(existingDoc)
+			err = s.DeleteUpload(upload)
 			if err != nil {
 				handleErr(c, err)
 				return
@@ -0,0 +1,304 @@
+package robokache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore is where document data is kept.
+// Missing blobs are reported with errors that match os.ErrNotExist.
+type BlobStore interface {
+	// Open returns a reader for the blob stored under key
+	Open(key string) (io.ReadSeekCloser, error)
+	// Create returns a writer for a blob that replaces the one stored under key
+	Create(key string) (BlobWriter, error)
+	// Delete removes the blob stored under key
+	Delete(key string) error
+	// Rename moves a blob to a new key, replacing any blob already there
+	Rename(oldKey string, newKey string) error
+	// Stat returns information about the blob stored under key
+	Stat(key string) (BlobInfo, error)
+	// List returns the keys of all blobs that start with prefix, in no
+	// particular order. It may include writes that were never committed.
+	List(prefix string) ([]string, error)
+}
+
+// BlobWriter writes a new blob. Nothing is stored under the key until Commit
+// succeeds, so a failed or interrupted write never replaces existing data.
+// Either Commit or Abort must be called.
+type BlobWriter interface {
+	io.Writer
+	// Commit stores everything written under the key
+	Commit() error
+	// Abort discards everything written
+	Abort() error
+}
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// openStore opens the BlobStore that the configuration names
+func openStore(config Config) (BlobStore, error) {
+	switch config.Storage {
+	case "filesystem":
+		files, err := newFileStore(config.DataDir + "/files")
+		if err != nil {
+			return nil, err
+		}
+		return files, nil
+	case "s3":
+		s3, err := newS3Store(config.S3)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open S3 storage: %v", err)
+		}
+		return s3, nil
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend \"%s\"", config.Storage)
+	}
+}
+
+// fileStore keeps each blob in a file named after its key
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *fileStore) Open(key string) (io.ReadSeekCloser, error) {
+	return os.Open(s.path(key))
+}
+
+// Create writes to a temporary file next to the blob,
+// which is renamed into place on commit
+func (s *fileStore) Create(key string) (BlobWriter, error) {
+	filename := s.path(key)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: file, filename: filename}, nil
+}
+
+func (s *fileStore) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *fileStore) Rename(oldKey string, newKey string) error {
+	newFilename := s.path(newKey)
+	err := os.MkdirAll(filepath.Dir(newFilename), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.path(oldKey), newFilename)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newFilename))
+}
+
+func (s *fileStore) Stat(key string) (BlobInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the directory. Temporary files of writes that were interrupted
+// by a crash are listed under their own names.
+func (s *fileStore) List(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// fileWriter writes a blob to a temporary file
+type fileWriter struct {
+	*os.File
+	filename string
+}
+
+// Commit flushes the file to disk before renaming it into place,
+// so a crash leaves either the old blob or the complete new one
+func (w *fileWriter) Commit() error {
+	err := w.Sync()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	err = os.Rename(w.Name(), w.filename)
+	if err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(w.filename))
+}
+
+func (w *fileWriter) Abort() error {
+	w.Close()
+	return os.Remove(w.Name())
+}
+
+// syncDir flushes a directory to disk so that renames in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// memoryStore keeps blobs in memory. It is meant for tests.
+type memoryStore struct {
+	mu    sync.Mutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *memoryStore) get(op string, key string) (memoryBlob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return blob, &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+	}
+	return blob, nil
+}
+
+func (s *memoryStore) Open(key string) (io.ReadSeekCloser, error) {
+	blob, err := s.get("open", key)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(blob.data)}, nil
+}
+
+// nopCloser adds a no-op Close to a reader that does not need closing
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Create(key string) (BlobWriter, error) {
+	return &memoryWriter{store: s, key: key}, nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return &fs.PathError{Op: "remove", Path: key, Err: fs.ErrNotExist}
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memoryStore) Rename(oldKey string, newKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	blob, ok := s.blobs[oldKey]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldKey, Err: fs.ErrNotExist}
+	}
+	s.blobs[newKey] = blob
+	delete(s.blobs, oldKey)
+	return nil
+}
+
+func (s *memoryStore) Stat(key string) (BlobInfo, error) {
+	blob, err := s.get("stat", key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+func (s *memoryStore) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0)
+	for key := range s.blobs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// memoryWriter buffers a blob until it is committed
+type memoryWriter struct {
+	bytes.Buffer
+	store *memoryStore
+	key   string
+}
+
+func (w *memoryWriter) Commit() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.blobs[w.key] = memoryBlob{data: w.Bytes(), modTime: time.Now()}
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.Reset()
+	return nil
+}
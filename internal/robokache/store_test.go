@@ -0,0 +1,80 @@
+package robokache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Run the same checks against every BlobStore implementation
+func testBlobStore(t *testing.T, s BlobStore) {
+	_, err := s.Open("missing")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = s.Stat("missing")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	err = s.Delete("missing")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	w, err := s.Create("blob")
+	assert.Nil(t, err)
+	_, err = io.WriteString(w, "some data")
+	assert.Nil(t, err)
+	// Nothing is stored before the blob is committed
+	_, err = s.Stat("blob")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Nil(t, w.Commit())
+
+	// An aborted write leaves the existing blob alone
+	w, err = s.Create("blob")
+	assert.Nil(t, err)
+	_, err = io.WriteString(w, "partial")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Abort())
+
+	info, err := s.Stat("blob")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("some data")), info.Size)
+
+	r, err := s.Open("blob")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, "some data", string(data))
+
+	keys, err := s.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"blob"}, keys)
+
+	assert.Nil(t, s.Rename("blob", "dir/renamed"))
+	keys, err = s.List("dir/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"dir/renamed"}, keys)
+	keys, err = s.List("other/")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+	_, err = s.Stat("blob")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	info, err = s.Stat("dir/renamed")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("some data")), info.Size)
+	err = s.Rename("missing", "renamed")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	assert.Nil(t, s.Delete("dir/renamed"))
+	_, err = s.Stat("dir/renamed")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := newFileStore(t.TempDir())
+	assert.Nil(t, err)
+	testBlobStore(t, s)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testBlobStore(t, newMemoryStore())
+}
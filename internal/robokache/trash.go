@@ -0,0 +1,135 @@
+package robokache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// GetTrash lists the documents the owner deleted, newest first. Documents
+// that were deleted along with their parent are only listed through it.
+func (s *Server) GetTrash(owner string) ([]Document, error) {
+	docs := make([]Document, 0)
+	err := s.db.Select(&docs, `
+		SELECT * FROM document WHERE owner=? AND deleted_with=id
+		ORDER BY deleted_at DESC, id DESC
+	`, owner)
+	return docs, err
+}
+
+// GetTrashedDocument gets a document that the owner deleted
+func (s *Server) GetTrashedDocument(owner string, id int) (Document, error) {
+	var doc Document
+	err := s.db.Get(&doc, `
+		SELECT * FROM document WHERE id=? AND owner=? AND deleted_with=id
+	`, id, owner)
+	if err == sql.ErrNoRows {
+		return doc, fmt.Errorf("not found: Check that the document is in your trash")
+	}
+	return doc, err
+}
+
+// RestoreDocument takes a document out of the trash along with the documents
+// that were deleted with it. It returns the IDs of the restored documents.
+func (s *Server) RestoreDocument(doc Document) ([]int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if doc.Parent != nil {
+		query := `SELECT deleted_at FROM document WHERE id=?`
+		if tx.isPostgres() {
+			query += " FOR SHARE"
+		}
+		var parentDeletedAt *time.Time
+		err = tx.Get(&parentDeletedAt, query, *doc.Parent)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("conflict: The parent of the document no longer exists")
+		} else if err != nil {
+			return nil, err
+		}
+		if parentDeletedAt != nil {
+			return nil, fmt.Errorf("conflict: Restore the parent of the document first")
+		}
+	}
+
+	var ids []int
+	err = tx.Select(&ids, `SELECT id FROM document WHERE deleted_with=?`, doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("not found: Check that the document is in your trash")
+	}
+	_, err = tx.Exec(`
+		UPDATE document SET deleted_at=NULL, deleted_with=NULL WHERE deleted_with=?
+	`, doc.ID)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// PurgeExpiredTrash purges the documents that have been in the trash for
+// longer than ROBOKACHE_TRASH_RETENTION. It returns the IDs of the purged
+// documents.
+func (s *Server) PurgeExpiredTrash() ([]int, error) {
+	purged := make([]int, 0)
+	if s.config.TrashRetention <= 0 {
+		return purged, nil
+	}
+
+	var trash []Document
+	err := s.db.Select(&trash, `SELECT * FROM document WHERE deleted_with=id`)
+	if err != nil {
+		return purged, err
+	}
+	done := make(map[int]bool)
+	for _, doc := range trash {
+		// Documents trashed before their parent go with the parent
+		if done[doc.ID] || time.Since(*doc.DeletedAt) < s.config.TrashRetention {
+			continue
+		}
+		ids, err := s.PurgeDocument(doc)
+		if err != nil && strings.HasPrefix(err.Error(), "not found") {
+			// Restored or purged by its owner in the meantime
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		for _, id := range ids {
+			done[id] = true
+		}
+		purged = append(purged, ids...)
+	}
+	return purged, nil
+}
+
+// PurgeTrashEvery calls PurgeExpiredTrash every interval until ctx is done
+func (s *Server) PurgeTrashEvery(ctx context.Context, interval time.Duration) {
+	if s.config.TrashRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purged, err := s.PurgeExpiredTrash()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to purge the trash")
+		} else if len(purged) > 0 {
+			log.WithFields(log.Fields{"documents": len(purged)}).Info("Purged expired trash")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
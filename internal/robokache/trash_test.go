@@ -0,0 +1,148 @@
+package robokache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	question, _ := srv.ids.idToHash(1)
+	first, _ := srv.ids.idToHash(2)
+	second, _ := srv.ids.idToHash(3)
+
+	// Delete an answer, then the question with the other answer
+	w := performRequest(router, "DELETE", "/api/document/"+first, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err := srv.db.Exec(`UPDATE document SET deleted_at=? WHERE id=2`, time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	w = performRequest(router, "DELETE", "/api/document/"+question+"?recursive=true", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string][]string
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.ElementsMatch(t, []string{question, second}, response["deleted"])
+
+	// Deleted documents are hidden
+	w = performRequest(router, "GET", "/api/document", &signedString, nil)
+	var documents []Document
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &documents))
+	assert.Len(t, documents, 3)
+	w = performRequest(router, "GET", "/api/document/"+second, &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	requestBody := "A new answer"
+	w = performRequest(router, "POST", "/api/document/"+question+"/children", &signedString, &requestBody)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The trash lists what was deleted, newest first
+	w = performRequest(router, "GET", "/api/trash", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &documents))
+	assert.Len(t, documents, 2)
+	assert.Equal(t, question, documents[0].Hash)
+	assert.Equal(t, first, documents[1].Hash)
+	assert.NotNil(t, documents[0].DeletedAt)
+
+	// Documents deleted with their parent are restored with it
+	w = performRequest(router, "POST", "/api/trash/"+second+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(router, "POST", "/api/trash/"+first+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = performRequest(router, "POST", "/api/trash/"+question+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.ElementsMatch(t, []string{question, second}, response["restored"])
+	w = performRequest(router, "POST", "/api/trash/"+first+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET", "/api/document", &signedString, nil)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &documents))
+	assert.Len(t, documents, 6)
+
+	// Other users' trash is out of reach
+	other, _ := srv.ids.idToHash(5)
+	_, err = srv.DeleteDocument(Document{ID: 5}, true)
+	assert.Nil(t, err)
+	w = performRequest(router, "GET", "/api/trash", &signedString, nil)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = performRequest(router, "POST", "/api/trash/"+other+"/restore", &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(router, "DELETE", "/api/trash/"+other, &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(router, "GET", "/api/trash", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	defer func(retention time.Duration) { srv.config.TrashRetention = retention }(srv.config.TrashRetention)
+	srv.clearDB()
+	srv.loadSampleData()
+
+	_, err := srv.DeleteDocument(Document{ID: 0}, false)
+	assert.Nil(t, err)
+	_, err = srv.DeleteDocument(Document{ID: 5}, true)
+	assert.Nil(t, err)
+	_, err = srv.db.Exec(`UPDATE document SET deleted_at=? WHERE deleted_with=5`,
+		time.Now().Add(-2*time.Hour))
+	assert.Nil(t, err)
+
+	// Nothing is purged without a retention window
+	srv.config.TrashRetention = 0
+	purged, err := srv.PurgeExpiredTrash()
+	assert.Nil(t, err)
+	assert.Empty(t, purged)
+
+	srv.config.TrashRetention = time.Hour
+	purged, err = srv.PurgeExpiredTrash()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int{5, 7, 8}, purged)
+	var remaining int
+	assert.Nil(t, srv.db.Get(&remaining, `SELECT COUNT(*) FROM document`))
+	assert.Equal(t, 6, remaining)
+
+	// Answers trashed before their question go with it
+	srv.clearDB()
+	srv.loadSampleData()
+	for _, id := range []int{2, 3, 1} {
+		_, err = srv.DeleteDocument(Document{ID: id}, false)
+		assert.Nil(t, err)
+	}
+	_, err = srv.db.Exec(`UPDATE document SET deleted_at=? WHERE deleted_at IS NOT NULL`,
+		time.Now().Add(-2*time.Hour))
+	assert.Nil(t, err)
+	purged, err = srv.PurgeExpiredTrash()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []int{1, 2, 3}, purged)
+	assert.Nil(t, srv.db.Get(&remaining, `SELECT COUNT(*) FROM document`))
+	assert.Equal(t, 6, remaining)
+}
+
+func TestUploadToTrashedDocument(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+	id, _ := srv.ids.idToHash(2)
+
+	w := performRequestWithHeaders(router, "POST",
+		fmt.Sprintf(`/api/document/%s/data/uploads`, id), &signedString, nil,
+		map[string]string{"Upload-Length": "5"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	location := w.Header().Get("Location")
+	_, err := srv.DeleteDocument(Document{ID: 2}, false)
+	assert.Nil(t, err)
+
+	// The data is not stored in the deleted document
+	chunk := "01234"
+	w = performRequestWithHeaders(router, "PATCH", location, &signedString, &chunk,
+		map[string]string{"Upload-Offset": "0"})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	var doc Document
+	assert.Nil(t, srv.db.Get(&doc, `SELECT * FROM document WHERE id=2`))
+	assert.Nil(t, doc.DataSHA256)
+	var blobs int
+	assert.Nil(t, srv.db.Get(&blobs, `SELECT COUNT(*) FROM blob`))
+	assert.Equal(t, 0, blobs)
+}
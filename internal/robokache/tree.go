@@ -0,0 +1,134 @@
+package robokache
+
+import "encoding/json"
+
+// maxTreeDepth is the most levels of descendants a tree has
+const maxTreeDepth = 1000
+
+// DocumentTree is a document with its descendants
+type DocumentTree struct {
+	Document
+	Children []*DocumentTree `json:"children"`
+}
+
+// addHash changes the IDs in the tree to hashes and marks the documents
+// the user owns
+func (t *DocumentTree) addHash(ids idCodec, userEmail *string) error {
+	err := t.Document.addHash(ids)
+	if err != nil {
+		return err
+	}
+	if userEmail != nil {
+		t.addOwned(*userEmail)
+	}
+	for _, child := range t.Children {
+		err = child.addHash(ids, userEmail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDocumentTree gets a document and its descendants up to depth levels
+// below it. Descendants are visible by the same rules as children, and the
+// descendants of a child that is not visible are not either.
+func (s *Server) GetDocumentTree(userEmail *string, id int, depth int) (*DocumentTree, error) {
+	root, err := s.GetDocument(userEmail, id)
+	if err != nil {
+		return nil, err
+	}
+	if depth > maxTreeDepth {
+		depth = maxTreeDepth
+	}
+
+	// Levels are counted so that a cycle ends at the depth limit
+	docs := make([]Document, 0)
+	err = s.db.Select(&docs, `
+		WITH RECURSIVE tree(id, depth) AS (
+			SELECT id, 0 FROM document WHERE id=?
+			UNION
+			SELECT document.id, tree.depth+1 FROM document
+			JOIN tree ON document.parent=tree.id
+			WHERE tree.depth<? AND (document.owner=? OR document.visibility>=?)
+			AND document.deleted_at IS NULL
+		)
+		SELECT document.* FROM document
+		JOIN (SELECT id, MIN(depth) AS depth FROM tree GROUP BY id) AS levels
+		ON document.id=levels.id
+		WHERE document.id<>?
+		ORDER BY levels.depth, document.id
+	`, id, depth, userEmail, shareable, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parents come before their children
+	tree := &DocumentTree{Document: root, Children: make([]*DocumentTree, 0)}
+	nodes := map[int]*DocumentTree{root.ID: tree}
+	for _, doc := range docs {
+		parent, ok := nodes[*doc.Parent]
+		if !ok {
+			continue
+		}
+		node := &DocumentTree{Document: doc, Children: make([]*DocumentTree, 0)}
+		parent.Children = append(parent.Children, node)
+		nodes[doc.ID] = node
+	}
+	return tree, nil
+}
+
+// Ancestor is a document above another one. Ancestors that the user is not
+// allowed to see are hidden, with only their IDs given.
+type Ancestor struct {
+	Document
+	Hidden bool `json:"hidden"`
+}
+
+func (a Ancestor) MarshalJSON() ([]byte, error) {
+	if a.Hidden {
+		return json.Marshal(map[string]interface{}{
+			"id": a.Hash, "parent": a.ParentHash, "hidden": true,
+		})
+	}
+	// Without the method, so that it doesn't call itself
+	type ancestor Ancestor
+	return json.Marshal(ancestor(a))
+}
+
+// GetAncestors gets the parent of a document, its parent and so on up to
+// the root, parent first
+func (s *Server) GetAncestors(userEmail *string, id int) ([]Ancestor, error) {
+	_, err := s.GetDocument(userEmail, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Levels are counted so that a cycle ends at the depth limit
+	docs := make([]Document, 0)
+	err = s.db.Select(&docs, `
+		WITH RECURSIVE ancestors(id, depth) AS (
+			SELECT parent, 1 FROM document WHERE id=? AND parent IS NOT NULL
+			UNION
+			SELECT document.parent, ancestors.depth+1 FROM document
+			JOIN ancestors ON document.id=ancestors.id
+			WHERE document.parent IS NOT NULL AND ancestors.depth<?
+		)
+		SELECT document.* FROM document
+		JOIN (SELECT id, MIN(depth) AS depth FROM ancestors GROUP BY id) AS levels
+		ON document.id=levels.id
+		WHERE document.id<>?
+		ORDER BY levels.depth
+	`, id, maxTreeDepth, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ancestors := make([]Ancestor, len(docs))
+	for i, doc := range docs {
+		visible := doc.DeletedAt == nil &&
+			((userEmail != nil && doc.Owner == *userEmail) || *doc.Visibility >= shareable)
+		ancestors[i] = Ancestor{Document: doc, Hidden: !visible}
+	}
+	return ancestors, nil
+}
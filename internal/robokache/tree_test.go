@@ -0,0 +1,106 @@
+package robokache
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// treeIDs flattens a tree into the IDs of each document's children
+func treeIDs(tree DocumentTree, children map[string][]string) {
+	ids := make([]string, 0)
+	for _, child := range tree.Children {
+		ids = append(ids, child.Hash)
+		treeIDs(*child, children)
+	}
+	children[tree.Hash] = ids
+}
+
+func getTree(t *testing.T, path string) map[string][]string {
+	w := performRequest(router, "GET", path, &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tree DocumentTree
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &tree))
+	children := make(map[string][]string)
+	treeIDs(tree, children)
+	return children
+}
+
+func TestGetDocumentTree(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	// A derived answer below an answer
+	addTestDocument(9, 2, "me@robokache.com", shareable)
+	// Descendants of documents that aren't visible are hidden too
+	addTestDocument(10, 5, "you@robokache.com", private)
+	addTestDocument(11, 10, "you@robokache.com", public)
+
+	assert.Equal(t, map[string][]string{
+		hashOf(1): {hashOf(2), hashOf(3)},
+		hashOf(2): {hashOf(9)},
+		hashOf(3): {},
+		hashOf(9): {},
+	}, getTree(t, "/api/document/"+hashOf(1)+"/tree"))
+	assert.Equal(t, map[string][]string{
+		hashOf(1): {hashOf(2), hashOf(3)},
+		hashOf(2): {},
+		hashOf(3): {},
+	}, getTree(t, "/api/document/"+hashOf(1)+"/tree?depth=1"))
+	assert.Equal(t, map[string][]string{
+		hashOf(1): {},
+	}, getTree(t, "/api/document/"+hashOf(1)+"/tree?depth=0"))
+	assert.Equal(t, map[string][]string{
+		hashOf(5): {hashOf(7), hashOf(8)},
+		hashOf(7): {},
+		hashOf(8): {},
+	}, getTree(t, "/api/document/"+hashOf(5)+"/tree"))
+
+	// Documents in the trash are left out
+	_, err := srv.DeleteDocument(Document{ID: 3}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		hashOf(1): {hashOf(2)},
+		hashOf(2): {hashOf(9)},
+		hashOf(9): {},
+	}, getTree(t, "/api/document/"+hashOf(1)+"/tree"))
+
+	w := performRequest(router, "GET", "/api/document/"+hashOf(6)+"/tree", &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequest(router, "GET", "/api/document/"+hashOf(1)+"/tree?depth=-1", &signedString, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetAncestors(t *testing.T) {
+	srv.clearDB()
+	srv.loadSampleData()
+
+	addTestDocument(9, 2, "me@robokache.com", shareable)
+	// The parent was made private after the answer was shared
+	addTestDocument(10, 6, "you@robokache.com", shareable)
+	srv.db.MustExec(`UPDATE document SET metadata='{"name": "secret"}' WHERE id=6`)
+
+	for _, jwt := range []*string{&signedString, nil} {
+		w := performRequest(router, "GET", "/api/document/"+hashOf(9)+"/ancestors", jwt, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var ancestors []map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &ancestors))
+		assert.Len(t, ancestors, 2)
+		assert.Equal(t, hashOf(2), ancestors[0]["id"])
+		assert.Equal(t, hashOf(1), ancestors[0]["parent"])
+		assert.Equal(t, hashOf(1), ancestors[1]["id"])
+		assert.Equal(t, false, ancestors[1]["hidden"])
+		assert.Equal(t, jwt != nil, ancestors[1]["owned"])
+	}
+
+	w := performRequest(router, "GET", "/api/document/"+hashOf(10)+"/ancestors", &signedString, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"id": "`+hashOf(6)+`", "parent": "", "hidden": true}]`, w.Body.String())
+
+	w = performRequest(router, "GET", "/api/document/"+hashOf(1)+"/ancestors", &signedString, nil)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = performRequest(router, "GET", "/api/document/"+hashOf(6)+"/ancestors", &signedString, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,366 @@
+package robokache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Resumable uploads let large data be sent in several requests.
+// Each request appends a chunk, which is stored as its own blob until the
+// upload is complete. The chunks are then joined into the document's data.
+
+// Kinds of uploads
+const (
+	// Replaces the data of an existing document
+	uploadData = "data"
+	// Creates a new child document with the data
+	uploadChild = "child"
+)
+
+type Upload struct {
+	ID    string `db:"id"    json:"id"`
+	Owner string `db:"owner" json:"-"`
+	// The document whose data is replaced, or the parent of the new document
+	Document int    `db:"document" json:"-"`
+	Kind     string `db:"kind"     json:"kind"`
+	// Total size of the data
+	Length int64 `db:"length" json:"length"`
+	// How much of the data has been received so far
+	Received  int64     `db:"received"   json:"offset"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	// When a request started joining the chunks, nil until then
+	FinishingAt *time.Time `db:"finishing_at" json:"-"`
+	// Passed on to the document with the data
+	DataInfo
+	// Key that the chunks are encrypted with
+	wrappedKey `json:"-"`
+}
+
+// CreateUpload starts an upload of the given length and returns its ID
+func (s *Server) CreateUpload(owner string, document int, kind string, length int64, info DataInfo) (string, error) {
+	if length < 0 {
+		return "", fmt.Errorf("bad request: Upload-Length must not be negative")
+	}
+	if s.config.MaxDataSize > 0 && length > s.config.MaxDataSize {
+		return "", s.dataSizeError()
+	}
+
+	// Turn away uploads that could never be finished
+	replaced := document
+	if kind == uploadChild {
+		err := s.checkDocumentQuota(s.db, owner)
+		if err != nil {
+			return "", err
+		}
+		replaced = -1
+	}
+	remaining, err := s.remainingBytes(s.db, owner, replaced)
+	if err != nil {
+		return "", err
+	}
+	if remaining >= 0 && length > remaining {
+		return "", s.byteQuotaError()
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	_, wrapped, err := s.masterKeys.newDataKey()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO upload(id, owner, document, kind, length, received,
+		                   key_id, wrapped_key, content_type, filename, sha256)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?)
+	`, id, owner, document, kind, length,
+		wrapped.KeyID, wrapped.WrappedKey, info.ContentType, info.Filename, info.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetUpload gets an upload that belongs to the given user
+func (s *Server) GetUpload(owner string, id string) (Upload, error) {
+	var upload Upload
+	err := s.db.Get(&upload, `SELECT * FROM upload WHERE id=? AND owner=?`, id, owner)
+	if err == sql.ErrNoRows {
+		return upload, fmt.Errorf("not found: Check that the upload exists and that you started it")
+	}
+	return upload, err
+}
+
+// Key for a new chunk of an upload. Chunks get unique keys so that
+// requests racing to write the same offset can't overwrite each other.
+func newChunkKey(upload string, offset int64) (string, error) {
+	random, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	return "uploads/" + upload + "/" + strconv.FormatInt(offset, 10) + "-" + random, nil
+}
+
+// WriteUpload appends the data read from r to an upload.
+// offset has to match what has been received so far. If reading r fails
+// part way, the data read until then is kept so the client can resume.
+// A complete upload takes no more data, but an empty request at its end is
+// accepted so that finishing it can be retried.
+func (s *Server) WriteUpload(upload Upload, offset int64, r io.Reader) (Upload, error) {
+	if upload.Received == upload.Length {
+		if offset != upload.Length {
+			return upload, fmt.Errorf("conflict: Upload is already complete")
+		}
+		n, err := io.Copy(io.Discard, io.LimitReader(r, 1))
+		if n > 0 {
+			return upload, fmt.Errorf("bad request: Data is longer than Upload-Length")
+		}
+		if err != nil {
+			return upload, fmt.Errorf("bad request: Failed to read data: %v", err)
+		}
+		return upload, nil
+	}
+	if offset != upload.Received {
+		return upload, fmt.Errorf("conflict: Upload-Offset does not match the %d bytes received so far", upload.Received)
+	}
+
+	key, err := newChunkKey(upload.ID, offset)
+	if err != nil {
+		return upload, err
+	}
+	uploadKey, err := s.masterKeys.unwrap(upload.wrappedKey)
+	if err != nil {
+		return upload, err
+	}
+	chunk, err := s.createBlob(key, chunkDataKey(uploadKey, key))
+	if err != nil {
+		return upload, err
+	}
+
+	// Read one byte more than is missing to notice data that is too long
+	remaining := upload.Length - upload.Received
+	body := &bodyReader{r: io.LimitReader(r, remaining+1)}
+	n, err := io.Copy(chunk, body)
+	if n > remaining {
+		chunk.Abort()
+		return upload, fmt.Errorf("bad request: Data is longer than Upload-Length")
+	}
+	if err != nil && body.err == nil {
+		// Writing to storage failed, so nothing was saved
+		chunk.Abort()
+		return upload, err
+	}
+	readErr := body.err
+
+	err = chunk.Commit()
+	if err != nil {
+		return upload, err
+	}
+
+	err = s.addChunk(upload, offset, n, key)
+	if err != nil {
+		s.store.Delete(key)
+		return upload, err
+	}
+	upload.Received = offset + n
+
+	if readErr != nil {
+		return upload, fmt.Errorf("bad request: Failed to read data: %v", readErr)
+	}
+	return upload, nil
+}
+
+// chunkDataKey derives the key a chunk is encrypted with from the key of its
+// upload. Every chunk needs its own key, since each starts its segment nonces at zero.
+func chunkDataKey(uploadKey []byte, chunk string) []byte {
+	if uploadKey == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, uploadKey)
+	mac.Write([]byte(chunk))
+	return mac.Sum(nil)
+}
+
+// addChunk records a stored chunk as part of an upload
+func (s *Server) addChunk(upload Upload, offset int64, size int64, key string) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only count the chunk if no other request wrote at this offset first
+	result, err := tx.Exec(`
+		UPDATE upload SET received=? WHERE id=? AND received=?
+	`, offset+size, upload.ID, offset)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return fmt.Errorf("conflict: Another request is writing to this upload")
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_chunk(upload, start, size, key) VALUES
+		(?, ?, ?, ?)
+	`, upload.ID, offset, size, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// chunkReader reads the chunks of an upload one after another,
+// opening each chunk only when it is reached
+type chunkReader struct {
+	store     BlobStore
+	keys      []string
+	uploadKey []byte
+	current   io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.keys) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := r.store.Open(r.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			if r.uploadKey != nil {
+				decrypted, err := newDecryptSeeker(chunk, chunkDataKey(r.uploadKey, r.keys[0]))
+				if err != nil {
+					chunk.Close()
+					return 0, err
+				}
+				chunk = decrypted
+			}
+			r.current = chunk
+			r.keys = r.keys[1:]
+		}
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// uploadedChunks lists the keys of the chunks of an upload in order
+func (s *Server) uploadedChunks(upload Upload) ([]string, error) {
+	keys := make([]string, 0)
+	err := s.db.Select(&keys, `
+		SELECT key FROM upload_chunk WHERE upload=? ORDER BY start
+	`, upload.ID)
+	return keys, err
+}
+
+// FinishUpload stores the data of a complete upload and returns the ID of
+// the document that has the data. The upload is removed.
+func (s *Server) FinishUpload(upload Upload) (int, error) {
+	if upload.Received != upload.Length {
+		return -1, fmt.Errorf("bad request: Upload is not complete")
+	}
+
+	// Only one request joins the chunks, so that retries can't add the
+	// document twice. The claim is given up if finishing fails.
+	result, err := s.db.Exec(`
+		UPDATE upload SET finishing_at=current_timestamp WHERE id=? AND finishing_at IS NULL
+	`, upload.ID)
+	if err != nil {
+		return -1, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if claimed == 0 {
+		return -1, fmt.Errorf("conflict: Upload is already being finished")
+	}
+	finished := false
+	defer func() {
+		if !finished {
+			s.db.Exec(`UPDATE upload SET finishing_at=NULL WHERE id=?`, upload.ID)
+		}
+	}()
+
+	keys, err := s.uploadedChunks(upload)
+	if err != nil {
+		return -1, err
+	}
+	uploadKey, err := s.masterKeys.unwrap(upload.wrappedKey)
+	if err != nil {
+		return -1, err
+	}
+	data := &chunkReader{store: s.store, keys: keys, uploadKey: uploadKey}
+	defer data.Close()
+
+	id := upload.Document
+	switch upload.Kind {
+	case uploadData:
+		err = s.SetData(id, data, upload.DataInfo)
+	case uploadChild:
+		var parent Document
+		parent, err = s.GetDocumentForEditing(upload.Owner, upload.Document)
+		if err != nil {
+			return -1, err
+		}
+		id, err = s.PostDocumentWithData(Document{
+			Parent:     &parent.ID,
+			Visibility: parent.Visibility,
+			Owner:      upload.Owner,
+		}, data, upload.DataInfo)
+	}
+	if err != nil {
+		return -1, err
+	}
+
+	finished = true
+	return id, s.DeleteUpload(upload)
+}
+
+// DeleteUpload removes an upload and the chunks received for it
+func (s *Server) DeleteUpload(upload Upload) error {
+	keys, err := s.uploadedChunks(upload)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = s.store.Delete(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	_, err = s.db.Exec(`DELETE FROM upload_chunk WHERE upload=?`, upload.ID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM upload WHERE id=?`, upload.ID)
+	return err
+}
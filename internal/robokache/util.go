@@ -1,7 +1,12 @@
 package robokache
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 )
 
 func getenv(key string, defaultValue string) string {
@@ -12,7 +17,46 @@ func getenv(key string, defaultValue string) string {
 	return value
 }
 
-var (
-	dataDir = getenv("ROBOKACHE_DATA_DIR", "./data")
-	dbFile  = dataDir + "/db.sqlite3"
-)
+// envParser reads typed ROBOKACHE_* variables, keeping the first error
+// so that a whole configuration can be read before checking it
+type envParser struct {
+	err error
+}
+
+func (p *envParser) int(key string, defaultValue int) int {
+	return int(p.int64(key, int64(defaultValue)))
+}
+
+func (p *envParser) int64(key string, defaultValue int64) int64 {
+	value, err := strconv.ParseInt(getenv(key, strconv.FormatInt(defaultValue, 10)), 10, 64)
+	if err != nil {
+		p.fail(fmt.Errorf("%s must be a number: %v", key, err))
+		return defaultValue
+	}
+	return value
+}
+
+func (p *envParser) duration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(getenv(key, defaultValue.String()))
+	if err != nil {
+		p.fail(fmt.Errorf("%s must be a duration: %v", key, err))
+		return defaultValue
+	}
+	return value
+}
+
+func (p *envParser) fail(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// randomID returns a random hex string that is hard to guess
+func randomID() (string, error) {
+	random := make([]byte, 16)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}